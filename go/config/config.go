@@ -2,12 +2,54 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	ProxyURL string
+	ProxyURL          string
+	ProxyListURL      string
+	UsersFile         string
+	QuotaFile         string
+	QuotaStateFile    string
+	AllowlistFile     string
+	AuthMode          string
+	AuthCallback      string
+	AuthCacheTTL      time.Duration
+	AuthMaxFails      int
+	AuthLockout       time.Duration
+	AuthLockoutMax    time.Duration
+	SourcesFile       string
+	AdminAddr         string
+	SourceFailures    int
+	SourceBackoff     time.Duration
+	SourceBackoffMax  time.Duration
+	SourceStaleWindow time.Duration
+	ExpiryWarnings    []time.Duration
+	ExpiryCheck       time.Duration
+	Strategy          string
+	Listeners         string
+	SessionTTL        time.Duration
+	SessionByIP       bool
+	RulesFile         string
+	GroupsFile        string
+	CheckTargets      []string
+	CheckInterval     time.Duration
+	CheckTimeout      time.Duration
+	CheckWorkers      int
+	CheckJitter       time.Duration
+	CheckStatus       []int
+	CheckBody         string
+	QuarantineBackoff time.Duration
+	QuarantineMax     time.Duration
+	RecoverySuccesses int
+	StateFile         string
+	StateKey          string
+	StateInterval     time.Duration
+	StateMaxAge       time.Duration
 }
 
 var AppConfig Config
@@ -19,7 +61,46 @@ func LoadConfig() error {
 	}
 
 	AppConfig = Config{
-		ProxyURL: getEnv("URL_PROXY", "http://localhost:3000/api/proxy/random"),
+		ProxyURL:          getEnv("URL_PROXY", "http://localhost:3000/api/proxy/random"),
+		ProxyListURL:      getEnv("URL_PROXY_ALL", "http://localhost:3000/api/proxy/all"),
+		UsersFile:         getEnv("USERS_FILE", "users.htpasswd"),
+		QuotaFile:         getEnv("QUOTA_FILE", "quotas.json"),
+		QuotaStateFile:    getEnv("QUOTA_STATE_FILE", "quota_usage.json"),
+		AllowlistFile:     getEnv("ALLOWLIST_FILE", "allowlist.txt"),
+		AuthMode:          getEnv("AUTH_MODE", "any"),
+		AuthCallback:      getEnv("AUTH_CALLBACK_URL", ""),
+		AuthCacheTTL:      getEnvDuration("AUTH_CALLBACK_TTL", time.Minute),
+		AuthMaxFails:      getEnvInt("AUTH_MAX_FAILURES", 5),
+		AuthLockout:       getEnvDuration("AUTH_LOCKOUT", time.Minute),
+		AuthLockoutMax:    getEnvDuration("AUTH_LOCKOUT_MAX", time.Hour),
+		SourcesFile:       getEnv("SOURCES_FILE", "sources.json"),
+		AdminAddr:         getEnv("ADMIN_ADDR", "127.0.0.1:8082"),
+		SourceFailures:    getEnvInt("SOURCE_FAILURE_THRESHOLD", 3),
+		SourceBackoff:     getEnvDuration("SOURCE_BACKOFF", 5*time.Second),
+		SourceBackoffMax:  getEnvDuration("SOURCE_BACKOFF_MAX", 5*time.Minute),
+		SourceStaleWindow: getEnvDuration("SOURCE_STALE_WINDOW", time.Hour),
+		ExpiryWarnings:    getEnvDurations("KEY_EXPIRY_WARNINGS", []time.Duration{72 * time.Hour, 24 * time.Hour}),
+		ExpiryCheck:       getEnvDuration("KEY_EXPIRY_CHECK_INTERVAL", time.Hour),
+		Strategy:          getEnv("STRATEGY", "random"),
+		Listeners:         getEnv("LISTENERS", ":8081"),
+		SessionTTL:        getEnvDuration("SESSION_TTL", 30*time.Minute),
+		SessionByIP:       getEnvBool("SESSION_BY_CLIENT_IP", false),
+		RulesFile:         getEnv("RULES_FILE", "rules.json"),
+		GroupsFile:        getEnv("GROUPS_FILE", "groups.json"),
+		CheckTargets:      getEnvList("HEALTH_CHECK_TARGETS", []string{"http://ip4.me/api"}),
+		CheckInterval:     getEnvDuration("HEALTH_CHECK_INTERVAL", time.Minute),
+		CheckTimeout:      getEnvDuration("HEALTH_CHECK_TIMEOUT", 10*time.Second),
+		CheckWorkers:      getEnvInt("HEALTH_CHECK_WORKERS", 10),
+		CheckJitter:       getEnvDuration("HEALTH_CHECK_JITTER", 10*time.Second),
+		CheckStatus:       getEnvInts("HEALTH_CHECK_EXPECT_STATUS", nil),
+		CheckBody:         getEnv("HEALTH_CHECK_EXPECT_BODY", ""),
+		QuarantineBackoff: getEnvDuration("QUARANTINE_BACKOFF", 30*time.Second),
+		QuarantineMax:     getEnvDuration("QUARANTINE_BACKOFF_MAX", 30*time.Minute),
+		RecoverySuccesses: getEnvInt("QUARANTINE_RECOVERY_SUCCESSES", 3),
+		StateFile:         getEnv("STATE_FILE", "pool_state.json"),
+		StateKey:          getEnv("STATE_KEY", ""),
+		StateInterval:     getEnvDuration("STATE_SAVE_INTERVAL", time.Minute),
+		StateMaxAge:       getEnvDuration("STATE_MAX_AGE", 24*time.Hour),
 	}
 
 	return nil
@@ -32,3 +113,77 @@ func getEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvDurations đọc danh sách duration phân tách bằng dấu phẩy, ví dụ "72h,24h"
+func getEnvDurations(key string, defaultValue []time.Duration) []time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var durations []time.Duration
+	for _, part := range strings.Split(value, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil {
+			return defaultValue
+		}
+		durations = append(durations, d)
+	}
+	return durations
+}
+
+// getEnvList đọc danh sách chuỗi phân tách bằng dấu phẩy, bỏ qua phần tử rỗng
+func getEnvList(key string, defaultValue []string) []string {
+	var values []string
+	for _, part := range strings.Split(os.Getenv(key), ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			values = append(values, part)
+		}
+	}
+	if len(values) == 0 {
+		return defaultValue
+	}
+	return values
+}
+
+// getEnvInts đọc danh sách số nguyên phân tách bằng dấu phẩy, ví dụ "200,204"
+func getEnvInts(key string, defaultValue []int) []int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var ints []int
+	for _, part := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return defaultValue
+		}
+		ints = append(ints, n)
+	}
+	return ints
+}
@@ -5,6 +5,8 @@ go 1.24.1
 require (
 	github.com/elazarl/goproxy v1.7.2
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/crypto v0.35.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -11,10 +11,6 @@ import (
 	"proxy/proxy"
 )
 
-const (
-	serverPort = ":8081"
-)
-
 func main() {
 	log.Println("[INFO] Khởi động proxy server")
 
@@ -22,38 +18,158 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	// Xác thực qua dịch vụ bên ngoài nếu có cấu hình, ngược lại dùng file user
+	if config.AppConfig.AuthCallback != "" {
+		proxy.ConfigureAuthenticator(proxy.NewCallbackAuthenticator(config.AppConfig.AuthCallback, config.AppConfig.AuthCacheTTL))
+		log.Printf("[INFO] Using auth callback %s", config.AppConfig.AuthCallback)
+	} else {
+		users, err := proxy.NewUserStore(config.AppConfig.UsersFile)
+		if err != nil {
+			log.Fatalf("Failed to load users: %v", err)
+		}
+		proxy.ConfigureAuthenticator(users)
+		go users.Watch(5 * time.Second)
+	}
+
+	// Khóa tạm thời IP/user đoán sai mật khẩu nhiều lần
+	proxy.ConfigureAuthLimiter(proxy.NewAuthLimiter(config.AppConfig.AuthMaxFails, config.AppConfig.AuthLockout, config.AppConfig.AuthLockoutMax))
+
+	// Tải allowlist IP của client (bỏ qua nếu không có file cấu hình)
+	allowlist, err := proxy.NewIPAllowlist(config.AppConfig.AllowlistFile)
+	if err != nil {
+		log.Printf("[WARN] IP allowlist disabled: %v", err)
+	} else {
+		go allowlist.Watch(5 * time.Second)
+	}
+	proxy.ConfigureIPAllowlist(allowlist, proxy.AuthMode(config.AppConfig.AuthMode))
+
+	// Tải giới hạn quota theo user (bỏ qua nếu không có file cấu hình)
+	quotas, err := proxy.NewQuotaManager(config.AppConfig.QuotaFile, config.AppConfig.QuotaStateFile)
+	if err != nil {
+		log.Printf("[WARN] Quota disabled: %v", err)
+	} else {
+		proxy.ConfigureQuota(quotas)
+		go quotas.Run(time.Minute)
+	}
+
+	// Tải rule định tuyến theo đích (bỏ qua nếu không có file cấu hình)
+	rules, err := proxy.NewRuleSet(config.AppConfig.RulesFile)
+	if err != nil {
+		log.Printf("[WARN] Routing rules disabled: %v", err)
+	} else {
+		proxy.ConfigureRules(rules)
+		go rules.Watch(5 * time.Second)
+	}
+
 	pm := proxy.NewProxyManager()
 
-	// Hàm để cập nhật proxy từ API
-	updateProxies := func() {
-		proxies, err := proxy.FetchProxyFromAPI()
+	// Strategy chọn upstream mặc định, từng listener có thể dùng strategy riêng
+	strategy, err := proxy.NewStrategy(config.AppConfig.Strategy)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	pm.SetStrategy(strategy)
+	pm.SetSessionOptions(config.AppConfig.SessionTTL, config.AppConfig.SessionByIP)
+
+	// Group upstream có chính sách riêng (bỏ qua nếu không có file cấu hình)
+	groupConfigs, err := proxy.LoadGroupsConfig(config.AppConfig.GroupsFile)
+	if err != nil {
+		log.Printf("[WARN] Upstream groups disabled: %v", err)
+	} else {
+		var groups []*proxy.ProxyGroup
+		for _, cfg := range groupConfigs {
+			group, err := proxy.NewProxyGroup(cfg)
+			if err != nil {
+				log.Fatalf("[ERROR] Invalid group %q: %v", cfg.Name, err)
+			}
+			groups = append(groups, group)
+		}
+		pm.SetGroups(groups)
+		log.Printf("[INFO] Loaded %d upstream groups", len(groups))
+	}
+
+	listeners, err := proxy.ParseListeners(config.AppConfig.Listeners)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	// Circuit breaker và stale window cho các nguồn upstream
+	proxy.ConfigureSourceHealth(proxy.SourceHealthConfig{
+		FailureThreshold: config.AppConfig.SourceFailures,
+		BaseBackoff:      config.AppConfig.SourceBackoff,
+		MaxBackoff:       config.AppConfig.SourceBackoffMax,
+		StaleWindow:      config.AppConfig.SourceStaleWindow,
+	})
+
+	// Đăng ký các nguồn upstream, mặc định đồng bộ toàn bộ key từ key manager
+	sources, err := proxy.LoadSourcesConfig(config.AppConfig.SourcesFile)
+	if err != nil {
+		log.Printf("[WARN] Using default API source: %v", err)
+		sources = []proxy.SourceConfig{{Type: "api-all", URL: config.AppConfig.ProxyListURL, Interval: "30s"}}
+	}
+
+	for _, cfg := range sources {
+		source, options, err := proxy.NewSourceFromConfig(cfg)
 		if err != nil {
-			log.Printf("[ERROR] Failed to fetch proxy from API: %v", err)
-			return
+			log.Fatalf("Invalid upstream source %q: %v", cfg.Type, err)
 		}
+		pm.AddSource(source, options)
+		log.Printf("[INFO] Registered upstream source %s (interval: %v, priority: %d, tag: %q)", source.Name(), options.Interval, options.Priority, options.Tag)
+	}
 
-		for _, p := range proxies {
-			pm.AddProxy(p)
-			log.Printf("[INFO] Added proxy: %s (Type: %v)", p.URL, p.Type)
+	// Khôi phục pool đã lưu để không phải khởi động với pool rỗng (cần STATE_KEY để mã hóa mật khẩu)
+	stateStore, err := proxy.NewStateStore(config.AppConfig.StateFile, config.AppConfig.StateKey, config.AppConfig.StateMaxAge)
+	if err != nil {
+		log.Printf("[WARN] Pool state persistence disabled: %v", err)
+	} else {
+		if err := stateStore.Restore(pm); err != nil {
+			log.Printf("[WARN] Failed to restore pool state: %v", err)
 		}
+		go stateStore.Run(pm, config.AppConfig.StateInterval)
 	}
 
-	// Cập nhật proxy ban đầu
-	updateProxies()
+	// Cập nhật proxy ban đầu và định kỳ theo từng nguồn
+	pm.StartSources()
 
-	// Cập nhật proxy định kỳ mỗi 5 phút
-	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
-		defer ticker.Stop()
-		for range ticker.C {
-			updateProxies()
+	// Kiểm tra sức khỏe chủ động mọi proxy trong pool
+	pm.SetHealthCheckOptions(proxy.HealthCheckOptions{
+		Targets:      config.AppConfig.CheckTargets,
+		Interval:     config.AppConfig.CheckInterval,
+		Timeout:      config.AppConfig.CheckTimeout,
+		Workers:      config.AppConfig.CheckWorkers,
+		Jitter:       config.AppConfig.CheckJitter,
+		ExpectStatus: config.AppConfig.CheckStatus,
+		ExpectBody:   config.AppConfig.CheckBody,
+	})
+	pm.SetQuarantineOptions(proxy.QuarantineOptions{
+		BaseBackoff:       config.AppConfig.QuarantineBackoff,
+		MaxBackoff:        config.AppConfig.QuarantineMax,
+		RecoverySuccesses: config.AppConfig.RecoverySuccesses,
+	})
+	go pm.StartHealthChecker()
+
+	// Cảnh báo key sắp hết hạn theo các mốc cấu hình
+	go pm.WatchExpiry(config.AppConfig.ExpiryWarnings, config.AppConfig.ExpiryCheck)
+	expiryWindow := time.Duration(0)
+	for _, lead := range config.AppConfig.ExpiryWarnings {
+		if lead > expiryWindow {
+			expiryWindow = lead
 		}
-	}()
+	}
+
+	// Khởi động proxy server trên từng listener
+	for _, listener := range listeners {
+		go func(listener proxy.ListenerConfig) {
+			if err := proxy.StartProxyListener(pm, listener.Addr, listener.Strategy); err != nil {
+				log.Fatalf("[ERROR] Failed to start proxy server: %v", err)
+			}
+		}(listener)
+	}
 
-	// Khởi động proxy server
+	// Khởi động admin server để xem thống kê pool
 	go func() {
-		if err := proxy.StartProxyServer(pm, serverPort); err != nil {
-			log.Fatalf("[ERROR] Failed to start proxy server: %v", err)
+		if err := proxy.StartAdminServer(pm, config.AppConfig.AdminAddr, expiryWindow); err != nil {
+			log.Printf("[ERROR] Admin server stopped: %v", err)
 		}
 	}()
 
@@ -63,4 +179,16 @@ func main() {
 	<-sigChan
 
 	log.Println("[INFO] Shutting down server...")
+
+	if quotas != nil {
+		if err := quotas.Save(); err != nil {
+			log.Printf("[ERROR] Failed to save quota state: %v", err)
+		}
+	}
+
+	if stateStore != nil {
+		if err := stateStore.Save(pm); err != nil {
+			log.Printf("[ERROR] Failed to save pool state: %v", err)
+		}
+	}
 }
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyStats là thông tin thống kê của một proxy trong pool
+type ProxyStats struct {
+	URL         string     `json:"url"`
+	Type        ProxyType  `json:"type"`
+	KeyID       string     `json:"key_id,omitempty"`
+	Carrier     string     `json:"carrier,omitempty"`
+	Location    string     `json:"location,omitempty"`
+	Expiration  string     `json:"expiration,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Expired     bool       `json:"expired"`
+	Source      string     `json:"source,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Priority    int        `json:"priority"`
+	Weight      int        `json:"weight"`
+	AddedAt     time.Time  `json:"added_at"`
+	RefreshedAt time.Time  `json:"refreshed_at"`
+	TTL         string     `json:"ttl,omitempty"`
+	ActiveConns int64      `json:"active_conns"`
+	LatencyMs   int64      `json:"latency_ms"`
+	HealthScore float64    `json:"health_score"`
+	IsWorking   bool       `json:"is_working"`
+	State       ProxyState `json:"state"`
+	RetryAt     *time.Time `json:"retry_at,omitempty"`
+	FailCount   int        `json:"fail_count"`
+	LastChecked time.Time  `json:"last_checked"`
+	CheckError  string     `json:"check_error,omitempty"`
+	Requests    int64      `json:"requests"`
+	Failures    int64      `json:"failures"`
+	LastUsed    time.Time  `json:"last_used"`
+}
+
+// Stats trả về thống kê của tất cả proxy trong pool (đã che mật khẩu và key)
+func (pm *ProxyManager) Stats() []ProxyStats {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	stats := make([]ProxyStats, 0, len(pm.proxies))
+	for _, p := range pm.proxies {
+		s := ProxyStats{
+			URL:         p.Redacted(),
+			Type:        p.Type,
+			Carrier:     p.Carrier,
+			Location:    p.Location,
+			Expiration:  p.Expiration,
+			Expired:     p.Expired(),
+			Source:      p.Source,
+			Tags:        p.Tags,
+			Priority:    p.Priority,
+			Weight:      p.effectiveWeight(),
+			AddedAt:     p.AddedAt,
+			RefreshedAt: p.RefreshedAt,
+			ActiveConns: atomic.LoadInt64(&p.ActiveConns),
+			LatencyMs:   p.Latency().Milliseconds(),
+			HealthScore: p.HealthScore(),
+			Requests:    atomic.LoadInt64(&p.Requests),
+			Failures:    atomic.LoadInt64(&p.Failures),
+			LastUsed:    p.LastUsed(),
+		}
+		if p.KeyID != "" {
+			s.KeyID = maskKey(p.KeyID)
+		}
+		if !p.ExpiresAt.IsZero() {
+			expiresAt := p.ExpiresAt
+			s.ExpiresAt = &expiresAt
+		}
+		if p.TTL > 0 {
+			s.TTL = p.TTL.String()
+		}
+
+		p.mu.Lock()
+		s.IsWorking = p.IsWorking
+		s.State = p.state()
+		s.FailCount = p.FailCount
+		s.LastChecked = p.LastChecked
+		s.CheckError = p.LastCheckError
+		if p.state() == ProxyStateQuarantined {
+			retryAt := p.RetryAt
+			s.RetryAt = &retryAt
+		}
+		p.mu.Unlock()
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// StartAdminServer khởi động HTTP server nội bộ để xem trạng thái pool
+func StartAdminServer(pm *ProxyManager, addr string, expiryWindow time.Duration) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, pm.Stats())
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, pm.HealthScores())
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, pm.StateEvents())
+	})
+	mux.HandleFunc("/sources", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, pm.SourceStatuses())
+	})
+	mux.HandleFunc("/groups", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, pm.GroupStatuses())
+	})
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, pm.Sessions())
+	})
+	mux.HandleFunc("/expiring", func(w http.ResponseWriter, r *http.Request) {
+		within := expiryWindow
+		if value := r.URL.Query().Get("within"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				http.Error(w, "invalid within duration", http.StatusBadRequest)
+				return
+			}
+			within = d
+		}
+		writeJSON(w, pm.ExpiringKeys(within))
+	})
+
+	logger.Info("Starting admin server on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// writeJSON ghi dữ liệu dạng JSON ra response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("Failed to write admin response: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthMode xác định cách client được chấp nhận
+type AuthMode string
+
+const (
+	// AuthModeBasic chỉ chấp nhận username/password
+	AuthModeBasic AuthMode = "basic"
+	// AuthModeIP chỉ chấp nhận client có IP nằm trong allowlist
+	AuthModeIP AuthMode = "ip"
+	// AuthModeAny chấp nhận allowlist khi client không gửi thông tin đăng nhập
+	AuthModeAny AuthMode = "any"
+)
+
+var (
+	ipAllowlist *IPAllowlist
+	authMode    = AuthModeBasic
+)
+
+// ConfigureIPAllowlist bật xác thực theo IP nguồn của client
+func ConfigureIPAllowlist(a *IPAllowlist, mode AuthMode) {
+	switch mode {
+	case AuthModeBasic, AuthModeIP, AuthModeAny:
+		authMode = mode
+	default:
+		logger.Warn("Unknown auth mode %q, using %q", mode, AuthModeAny)
+		authMode = AuthModeAny
+	}
+	ipAllowlist = a
+}
+
+type allowlistEntry struct {
+	network  *net.IPNet
+	username string
+}
+
+// IPAllowlist ánh xạ dải IP/CIDR của client sang user để tính usage
+type IPAllowlist struct {
+	path    string
+	mu      sync.RWMutex
+	entries []allowlistEntry
+	modTime time.Time
+}
+
+// NewIPAllowlist tạo allowlist và tải dữ liệu từ file
+func NewIPAllowlist(path string) (*IPAllowlist, error) {
+	a := &IPAllowlist{path: path}
+	if err := a.Load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Load đọc file allowlist, mỗi dòng có dạng: <username> <ip|cidr> [<ip|cidr>...]
+func (a *IPAllowlist) Load() error {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return fmt.Errorf("failed to open allowlist file: %v", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat allowlist file: %v", err)
+	}
+
+	var entries []allowlistEntry
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			logger.Warn("Skipping invalid allowlist entry at line %d", lineNum)
+			continue
+		}
+
+		for _, value := range fields[1:] {
+			network, err := parseCIDR(value)
+			if err != nil {
+				logger.Warn("Skipping invalid allowlist address %q at line %d: %v", value, lineNum, err)
+				continue
+			}
+			entries = append(entries, allowlistEntry{network: network, username: fields[0]})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read allowlist file: %v", err)
+	}
+
+	a.mu.Lock()
+	a.entries = entries
+	a.modTime = stat.ModTime()
+	a.mu.Unlock()
+
+	logger.Info("Loaded %d allowlist entries from %s", len(entries), a.path)
+	return nil
+}
+
+// Watch theo dõi file allowlist và tải lại khi file thay đổi
+func (a *IPAllowlist) Watch(interval time.Duration) {
+	a.mu.RLock()
+	modTime := a.modTime
+	a.mu.RUnlock()
+
+	watchFile(a.path, modTime, interval, a.Load)
+}
+
+// Lookup trả về identity của user sở hữu dải IP chứa ip
+func (a *IPAllowlist) Lookup(ip net.IP) *Identity {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, entry := range a.entries {
+		if entry.network.Contains(ip) {
+			return &Identity{Username: entry.username}
+		}
+	}
+	return nil
+}
+
+// parseCIDR chấp nhận cả IP đơn lẻ lẫn CIDR
+func parseCIDR(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address")
+		}
+		if ip.To4() != nil {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+// allowlistIdentity trả về identity nếu IP của client được phép truy cập không cần mật khẩu
+func allowlistIdentity(ip net.IP) *Identity {
+	if authMode == AuthModeBasic || ipAllowlist == nil || ip == nil {
+		return nil
+	}
+	return ipAllowlist.Lookup(ip)
+}
+
+// remoteIP lấy IP nguồn của kết nối client
+func remoteIP(conn net.Conn) net.IP {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// ipString trả về chuỗi IP, rỗng nếu không xác định được
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
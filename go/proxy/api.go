@@ -5,9 +5,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
-	"strings"
-	"sync"
 	"time"
 
 	"proxy/config"
@@ -30,115 +27,73 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
-var (
-	lastAPICall time.Time
-	apiMutex    sync.Mutex
-	proxyCache  = make(map[ProxyType]*Proxy)
-	cacheMutex  sync.Mutex
-)
+// FetchProxyFromAPI gọi API để lấy proxy mới
+func FetchProxyFromAPI() ([]*Proxy, error) {
+	return fetchProxyFromURL(config.AppConfig.ProxyURL)
+}
 
-// parseProxyString phân tích chuỗi proxy theo định dạng IP:PORT:USER:PASS
-func parseProxyString(proxyStr string) (host, port, username, password string, err error) {
-	parts := strings.Split(proxyStr, ":")
-	if len(parts) != 4 {
-		return "", "", "", "", fmt.Errorf("invalid proxy format: %s, expected IP:PORT:USER:PASS", proxyStr)
+// fetchProxyFromURL gọi endpoint random của key manager tại apiURL
+func fetchProxyFromURL(apiURL string) ([]*Proxy, error) {
+	body, err := getAPI(apiURL)
+	if err != nil {
+		return nil, err
 	}
 
-	// Kiểm tra IP
-	host = parts[0]
-	if !isValidIP(host) {
-		return "", "", "", "", fmt.Errorf("invalid IP address: %s", host)
+	var proxyResp ProxyResponse
+	if err := json.Unmarshal(body, &proxyResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
 	}
 
-	// Kiểm tra PORT
-	port = parts[1]
-	if !isValidPort(port) {
-		return "", "", "", "", fmt.Errorf("invalid port: %s", port)
+	proxies, err := proxiesFromResponse(proxyResp)
+	if err != nil {
+		return nil, err
 	}
 
-	// Kiểm tra USERNAME và PASSWORD
-	username = parts[2]
-	password = parts[3]
-	if username == "" || password == "" {
-		return "", "", "", "", fmt.Errorf("username or password is empty")
+	if len(proxies) == 0 {
+		return nil, fmt.Errorf("no valid proxies found in API response")
 	}
 
-	return host, port, username, password, nil
+	return proxies, nil
 }
 
-// isValidIP kiểm tra xem chuỗi có phải là IP hợp lệ không
-func isValidIP(ip string) bool {
-	parts := strings.Split(ip, ".")
-	if len(parts) != 4 {
-		return false
-	}
-
-	for _, part := range parts {
-		if len(part) == 0 || len(part) > 3 {
-			return false
-		}
-		for _, c := range part {
-			if c < '0' || c > '9' {
-				return false
-			}
-		}
-		num := 0
-		fmt.Sscanf(part, "%d", &num)
-		if num < 0 || num > 255 {
-			return false
-		}
-	}
-
-	return true
+// ProxyListResponse là kết quả của endpoint trả về toàn bộ key đang hoạt động
+type ProxyListResponse struct {
+	Proxies []ProxyResponse `json:"proxies"`
 }
 
-// isValidPort kiểm tra xem chuỗi có phải là port hợp lệ không
-func isValidPort(port string) bool {
-	num := 0
-	_, err := fmt.Sscanf(port, "%d", &num)
+// fetchAllProxiesFromURL gọi endpoint liệt kê tất cả key đang hoạt động của key manager,
+// bỏ qua các key có proxy sai định dạng
+func fetchAllProxiesFromURL(apiURL string) ([]*Proxy, error) {
+	body, err := getAPI(apiURL)
 	if err != nil {
-		return false
-	}
-	return num > 0 && num < 65536
-}
-
-// createProxyURL tạo URL proxy đúng định dạng
-func createProxyURL(host, port, username, password string, proxyType ProxyType) string {
-	var scheme string
-	if proxyType == ProxyTypeHTTP {
-		scheme = "http"
-	} else {
-		scheme = "socks5"
+		return nil, err
 	}
 
-	proxyURL := &url.URL{
-		Scheme: scheme,
-		Host:   fmt.Sprintf("%s:%s", host, port),
+	var listResp ProxyListResponse
+	if err := json.Unmarshal(body, &listResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
 	}
 
-	if username != "" && password != "" {
-		proxyURL.User = url.UserPassword(username, password)
+	proxies := make([]*Proxy, 0, len(listResp.Proxies)*2)
+	for _, proxyResp := range listResp.Proxies {
+		keyProxies, err := proxiesFromResponse(proxyResp)
+		if err != nil {
+			logger.Warn("Skipping key %s: %v", maskKey(proxyResp.Key), err)
+			continue
+		}
+		proxies = append(proxies, keyProxies...)
 	}
 
-	return proxyURL.String()
+	return proxies, nil
 }
 
-// FetchProxyFromAPI gọi API để lấy proxy mới
-func FetchProxyFromAPI() ([]*Proxy, error) {
-	apiMutex.Lock()
-	defer apiMutex.Unlock()
-
-	// Đợi ít nhất 1 giây giữa các lần gọi API
-	timeSinceLastCall := time.Since(lastAPICall)
-	if timeSinceLastCall < time.Second {
-		time.Sleep(time.Second - timeSinceLastCall)
-	}
-
+// getAPI gọi API của key manager và trả về body của response thành công
+func getAPI(apiURL string) ([]byte, error) {
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
 
-	resp, err := client.Get(config.AppConfig.ProxyURL)
+	resp, err := client.Get(apiURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch proxy from API: %v", err)
 	}
@@ -159,91 +114,64 @@ func FetchProxyFromAPI() ([]*Proxy, error) {
 		return nil, fmt.Errorf("API returned non-200 status code: %d", resp.StatusCode)
 	}
 
-	var proxyResp ProxyResponse
-	if err := json.Unmarshal(body, &proxyResp); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
-	}
+	return body, nil
+}
 
+// proxiesFromResponse tạo proxy HTTP và SOCKS5 từ dữ liệu của một key
+func proxiesFromResponse(proxyResp ProxyResponse) ([]*Proxy, error) {
 	proxies := make([]*Proxy, 0)
 
+	expiresAt, err := parseExpiration(proxyResp.ProxyData.TokenExpirationDate)
+	if err != nil {
+		logger.Warn("Ignoring expiration of key %s: %v", maskKey(proxyResp.Key), err)
+	}
+
 	// Tạo proxy HTTP
 	if proxyResp.ProxyData.ProxyHTTP != "" {
-		host, port, username, password, err := parseProxyString(proxyResp.ProxyData.ProxyHTTP)
+		httpProxy, err := parseKeyProxy(proxyResp.ProxyData.ProxyHTTP, ProxyTypeHTTP)
 		if err != nil {
 			return nil, fmt.Errorf("invalid HTTP proxy format: %v", err)
 		}
-
-		httpProxy := &Proxy{
-			URL:         createProxyURL(host, port, username, password, ProxyTypeHTTP),
-			Username:    username,
-			Password:    password,
-			Type:        ProxyTypeHTTP,
-			LastUsed:    time.Now(),
-			IsWorking:   true,
-			LastChecked: time.Now(),
-		}
+		applyKeyData(httpProxy, proxyResp, expiresAt)
 		proxies = append(proxies, httpProxy)
-
-		// Cập nhật cache
-		cacheMutex.Lock()
-		proxyCache[ProxyTypeHTTP] = httpProxy
-		cacheMutex.Unlock()
 	}
 
 	// Tạo proxy SOCKS5
 	if proxyResp.ProxyData.ProxySOCKS5 != "" {
-		host, port, username, password, err := parseProxyString(proxyResp.ProxyData.ProxySOCKS5)
+		socks5Proxy, err := parseKeyProxy(proxyResp.ProxyData.ProxySOCKS5, ProxyTypeSOCKS5)
 		if err != nil {
 			return nil, fmt.Errorf("invalid SOCKS5 proxy format: %v", err)
 		}
-
-		socks5Proxy := &Proxy{
-			URL:         createProxyURL(host, port, username, password, ProxyTypeSOCKS5),
-			Username:    username,
-			Password:    password,
-			Type:        ProxyTypeSOCKS5,
-			LastUsed:    time.Now(),
-			IsWorking:   true,
-			LastChecked: time.Now(),
-		}
+		applyKeyData(socks5Proxy, proxyResp, expiresAt)
 		proxies = append(proxies, socks5Proxy)
-
-		// Cập nhật cache
-		cacheMutex.Lock()
-		proxyCache[ProxyTypeSOCKS5] = socks5Proxy
-		cacheMutex.Unlock()
-	}
-
-	if len(proxies) == 0 {
-		return nil, fmt.Errorf("no valid proxies found in API response")
 	}
 
-	lastAPICall = time.Now()
 	return proxies, nil
 }
 
-// GetProxyForRequest lấy proxy mới cho mỗi request
-func GetProxyForRequest(proxyType ProxyType) (*Proxy, error) {
-	// Luôn cố gắng lấy proxy mới từ API
-	proxies, err := FetchProxyFromAPI()
+// parseKeyProxy phân tích proxy của một key (HOST:PORT:USER:PASS hoặc các định dạng khác
+// ParseProxy nhận), key manager luôn cấp proxy có thông tin đăng nhập
+func parseKeyProxy(raw string, proxyType ProxyType) (*Proxy, error) {
+	p, err := ParseProxy(raw, proxyType)
 	if err != nil {
-		// Nếu gọi API lỗi, thử lấy từ cache
-		cacheMutex.Lock()
-		cachedProxy, exists := proxyCache[proxyType]
-		cacheMutex.Unlock()
-
-		if exists && time.Since(cachedProxy.LastUsed) < 30*time.Second {
-			return cachedProxy, nil
-		}
-		return nil, fmt.Errorf("failed to get proxy: %v", err)
+		return nil, err
 	}
-
-	// Tìm proxy phù hợp với loại yêu cầu
-	for _, proxy := range proxies {
-		if proxy.Type == proxyType {
-			return proxy, nil
-		}
+	if p.Type != proxyType {
+		return nil, fmt.Errorf("expected %s proxy, got %s", proxyType, p.Type)
+	}
+	if p.Username == "" {
+		return nil, fmt.Errorf("username or password is empty")
 	}
+	return p, nil
+}
 
-	return nil, fmt.Errorf("no suitable proxy found for type %s", proxyType)
+// applyKeyData gắn trạng thái ban đầu và metadata của key vào proxy
+func applyKeyData(p *Proxy, proxyResp ProxyResponse, expiresAt time.Time) {
+	p.IsWorking = true
+	p.LastChecked = time.Now()
+	p.Carrier = proxyResp.ProxyData.Network
+	p.Location = proxyResp.ProxyData.Location
+	p.KeyID = proxyResp.Key
+	p.Expiration = proxyResp.ProxyData.TokenExpirationDate
+	p.ExpiresAt = expiresAt
 }
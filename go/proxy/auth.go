@@ -3,33 +3,47 @@ package proxy
 import (
 	"encoding/base64"
 	"fmt"
+	"net"
 	"strings"
 )
 
 // checkAuth kiểm tra xác thực proxy
-func checkAuth(headers map[string]string) (bool, string) {
+func checkAuth(headers map[string]string, protocol string, clientIP net.IP, targetHost string) (*Identity, error) {
 	auth := headers["Proxy-Authorization"]
-	if auth == "" {
-		return false, "Missing Proxy-Authorization header"
+
+	// Client không gửi thông tin đăng nhập (hoặc chỉ dùng IP) thì xét allowlist
+	if auth == "" || authMode == AuthModeIP {
+		if identity := allowlistIdentity(clientIP); identity != nil {
+			return identity, nil
+		}
+		if authMode == AuthModeIP {
+			return nil, fmt.Errorf("client IP %s is not allowlisted", clientIP)
+		}
+		return nil, fmt.Errorf("missing Proxy-Authorization header")
 	}
 
 	if !strings.HasPrefix(auth, "Basic ") {
-		return false, "Invalid authentication method, expected Basic"
+		return nil, fmt.Errorf("invalid authentication method, expected Basic")
 	}
 
 	// Decode base64
 	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
 	if err != nil {
-		return false, fmt.Sprintf("Invalid base64 encoding: %v", err)
+		return nil, fmt.Errorf("invalid base64 encoding: %v", err)
 	}
 
-	// Kiểm tra thông tin đăng nhập
-	credentials := string(decoded)
-	expectedCredentials := "zpoxy:manhdz"
-
-	if credentials != expectedCredentials {
-		return false, fmt.Sprintf("Invalid credentials: %s", credentials)
+	// Tách username và password
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid credentials format")
 	}
 
-	return true, ""
+	// Kiểm tra thông tin đăng nhập
+	return authenticate(&AuthRequest{
+		Username:   username,
+		Password:   password,
+		Protocol:   protocol,
+		ClientIP:   ipString(clientIP),
+		TargetHost: targetHost,
+	})
 }
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BreakerState là trạng thái của circuit breaker
+type BreakerState string
+
+const (
+	// BreakerClosed cho phép gọi nguồn bình thường
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen chặn mọi lần gọi cho tới khi hết thời gian backoff
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen cho phép một lần gọi thử sau khi hết backoff
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// breakerOpenError được trả về khi circuit breaker đang mở
+type breakerOpenError struct {
+	remaining time.Duration
+}
+
+func (e *breakerOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open, retry in %v", e.remaining.Round(time.Second))
+}
+
+// SourceHealthConfig cấu hình circuit breaker và thời gian tiếp tục dùng proxy cũ của các nguồn
+type SourceHealthConfig struct {
+	// FailureThreshold là số lần lỗi liên tiếp trước khi mở breaker
+	FailureThreshold int
+	// BaseBackoff là thời gian mở breaker lần đầu, tăng gấp đôi sau mỗi lần mở lại
+	BaseBackoff time.Duration
+	// MaxBackoff là thời gian mở breaker tối đa
+	MaxBackoff time.Duration
+	// StaleWindow là thời gian tiếp tục phục vụ proxy của nguồn kể từ lần tải thành công cuối,
+	// 0 nghĩa là không giới hạn
+	StaleWindow time.Duration
+}
+
+var sourceHealthConfig = SourceHealthConfig{
+	FailureThreshold: 3,
+	BaseBackoff:      5 * time.Second,
+	MaxBackoff:       5 * time.Minute,
+	StaleWindow:      time.Hour,
+}
+
+// ConfigureSourceHealth thay thế cấu hình breaker mặc định cho các nguồn đăng ký sau đó
+func ConfigureSourceHealth(cfg SourceHealthConfig) {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 1
+	}
+	sourceHealthConfig = cfg
+}
+
+// CircuitBreaker ngắt các lần gọi tới nguồn đang lỗi, mở lại với backoff tăng dần
+type CircuitBreaker struct {
+	threshold   int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	mu          sync.Mutex
+	state       BreakerState
+	failures    int
+	opens       int
+	openUntil   time.Time
+	lastError   string
+	lastSuccess time.Time
+	lastFailure time.Time
+}
+
+// NewCircuitBreaker tạo breaker mở sau threshold lần lỗi liên tiếp
+func NewCircuitBreaker(threshold int, baseBackoff, maxBackoff time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold:   threshold,
+		baseBackoff: baseBackoff,
+		maxBackoff:  maxBackoff,
+		state:       BreakerClosed,
+	}
+}
+
+// Allow trả về lỗi nếu breaker đang mở, chuyển sang half-open khi hết backoff
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != BreakerOpen {
+		return nil
+	}
+
+	remaining := time.Until(b.openUntil)
+	if remaining > 0 {
+		return &breakerOpenError{remaining: remaining}
+	}
+
+	b.state = BreakerHalfOpen
+	return nil
+}
+
+// Success đóng breaker sau một lần gọi thành công
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.opens = 0
+	b.lastSuccess = time.Now()
+}
+
+// Failure ghi nhận một lần gọi lỗi, trả về true nếu breaker vừa chuyển sang open
+func (b *CircuitBreaker) Failure(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.failures++
+	b.lastFailure = now
+	if err != nil {
+		b.lastError = err.Error()
+	}
+
+	// Lần thử ở trạng thái half-open lỗi thì mở lại ngay với backoff dài hơn
+	if b.state != BreakerHalfOpen && b.failures < b.threshold {
+		return false
+	}
+
+	backoff := b.baseBackoff << b.opens
+	if backoff > b.maxBackoff || backoff <= 0 {
+		backoff = b.maxBackoff
+	}
+
+	b.state = BreakerOpen
+	b.openUntil = now.Add(backoff)
+	b.opens++
+	return true
+}
+
+// BreakerStatus là ảnh chụp trạng thái của circuit breaker
+type BreakerStatus struct {
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	LastError           string       `json:"last_error,omitempty"`
+	LastSuccess         time.Time    `json:"last_success"`
+	LastFailure         time.Time    `json:"last_failure"`
+	RetryAt             *time.Time   `json:"retry_at,omitempty"`
+}
+
+// Status trả về trạng thái hiện tại của breaker
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		LastError:           b.lastError,
+		LastSuccess:         b.lastSuccess,
+		LastFailure:         b.lastFailure,
+	}
+	if b.state == BreakerOpen {
+		retryAt := b.openUntil
+		status.RetryAt = &retryAt
+	}
+	return status
+}
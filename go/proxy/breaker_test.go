@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerStatusRetryAt(t *testing.T) {
+	b := NewCircuitBreaker(1, time.Minute, time.Hour)
+
+	data, err := json.Marshal(b.Status())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "retry_at") {
+		t.Fatalf("closed breaker reports retry_at: %s", data)
+	}
+
+	if !b.Failure(errors.New("fetch failed")) {
+		t.Fatal("breaker did not open")
+	}
+	status := b.Status()
+	if status.RetryAt == nil || time.Until(*status.RetryAt) <= 0 {
+		t.Fatalf("open breaker retry_at = %v, want a future time", status.RetryAt)
+	}
+	data, err = json.Marshal(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"retry_at"`) {
+		t.Fatalf("open breaker omits retry_at: %s", data)
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// callbackRequest là dữ liệu gửi tới dịch vụ xác thực bên ngoài
+type callbackRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	ClientIP   string `json:"client_ip"`
+	Protocol   string `json:"protocol"`
+	TargetHost string `json:"target_host"`
+}
+
+// callbackResponse là kết quả dịch vụ xác thực trả về
+type callbackResponse struct {
+	Allow    bool         `json:"allow"`
+	Username string       `json:"username"`
+	Message  string       `json:"message"`
+	Limits   *QuotaLimits `json:"limits"`
+	Groups   []string     `json:"groups"`
+}
+
+type callbackCacheEntry struct {
+	response  callbackResponse
+	expiresAt time.Time
+}
+
+// CallbackAuthenticator hỏi dịch vụ HTTP bên ngoài để quyết định cho phép hay từ chối client
+type CallbackAuthenticator struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+	mu     sync.Mutex
+	cache  map[string]callbackCacheEntry
+}
+
+// NewCallbackAuthenticator tạo authenticator gọi tới url và cache kết quả trong ttl
+func NewCallbackAuthenticator(url string, ttl time.Duration) *CallbackAuthenticator {
+	return &CallbackAuthenticator{
+		url: url,
+		ttl: ttl,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+		cache: make(map[string]callbackCacheEntry),
+	}
+}
+
+// Authenticate gửi thông tin client tới callback, dùng kết quả đã cache nếu còn hạn
+func (c *CallbackAuthenticator) Authenticate(req *AuthRequest) (*Identity, error) {
+	body, err := json.Marshal(callbackRequest{
+		Username:   req.Username,
+		Password:   req.Password,
+		ClientIP:   req.ClientIP,
+		Protocol:   req.Protocol,
+		TargetHost: req.TargetHost,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode auth callback request: %v", err)
+	}
+
+	// Khóa cache là hash của thông tin client và đích để không giữ mật khẩu dạng rõ trong bộ nhớ;
+	// dịch vụ có thể quyết định theo đích nên kết quả của đích này không dùng cho đích khác
+	key := callbackCacheKey(req)
+
+	resp, cached := c.lookup(key)
+	if !cached {
+		resp, err = c.call(body)
+		if err != nil {
+			return nil, err
+		}
+		c.store(key, resp)
+	}
+
+	if !resp.Allow {
+		if resp.Message != "" {
+			return nil, fmt.Errorf("%w: auth callback denied user %q: %s", errInvalidCredentials, req.Username, resp.Message)
+		}
+		return nil, fmt.Errorf("%w: auth callback denied user %q", errInvalidCredentials, req.Username)
+	}
+
+	identity := &Identity{
+		Username: req.Username,
+		Groups:   append([]string(nil), resp.Groups...),
+	}
+	if resp.Username != "" {
+		identity.Username = resp.Username
+	}
+	if resp.Limits != nil {
+		limits := *resp.Limits
+		identity.Limits = &limits
+	}
+
+	return identity, nil
+}
+
+// callbackCacheKey tạo khóa cache từ username, password, IP client, giao thức và đích
+func callbackCacheKey(req *AuthRequest) string {
+	h := sha256.New()
+	for _, field := range []string{req.Username, req.Password, req.ClientIP, req.Protocol, req.TargetHost} {
+		// Ghi độ dài trước mỗi trường để "ab"+"c" và "a"+"bc" không trùng khóa
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// call thực hiện request POST tới dịch vụ xác thực
+func (c *CallbackAuthenticator) call(body []byte) (callbackResponse, error) {
+	var result callbackResponse
+
+	resp, err := c.client.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return result, fmt.Errorf("auth callback failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return result, fmt.Errorf("failed to read auth callback response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("auth callback returned non-200 status code: %d", resp.StatusCode)
+	}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return result, fmt.Errorf("failed to unmarshal auth callback response: %v", err)
+	}
+
+	return result, nil
+}
+
+func (c *CallbackAuthenticator) lookup(key string) (callbackResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, exists := c.cache[key]
+	if !exists {
+		return callbackResponse{}, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.cache, key)
+		return callbackResponse{}, false
+	}
+	return entry.response, true
+}
+
+func (c *CallbackAuthenticator) store(key string, resp callbackResponse) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Dọn các kết quả đã hết hạn khi cache lớn dần
+	now := time.Now()
+	if len(c.cache) >= 10000 {
+		for k, entry := range c.cache {
+			if now.After(entry.expiresAt) {
+				delete(c.cache, k)
+			}
+		}
+	}
+
+	c.cache[key] = callbackCacheEntry{
+		response:  resp,
+		expiresAt: now.Add(c.ttl),
+	}
+}
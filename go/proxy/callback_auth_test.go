@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallbackCachePerTarget(t *testing.T) {
+	var calls int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		var req callbackRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(callbackResponse{Allow: req.TargetHost == "a.com:443"})
+	}))
+	defer server.Close()
+
+	auth := NewCallbackAuthenticator(server.URL, time.Minute)
+	request := func(target string) error {
+		_, err := auth.Authenticate(&AuthRequest{
+			Username:   "alice",
+			Password:   "secret",
+			Protocol:   "https",
+			ClientIP:   "1.2.3.4",
+			TargetHost: target,
+		})
+		return err
+	}
+
+	if err := request("a.com:443"); err != nil {
+		t.Fatalf("a.com: %v", err)
+	}
+	if err := request("a.com:443"); err != nil {
+		t.Fatalf("cached a.com: %v", err)
+	}
+	if got := atomic.LoadInt64(&calls); got != 1 {
+		t.Fatalf("got %d callback calls, want 1 (second request cached)", got)
+	}
+
+	// Kết quả cho phép của a.com không được dùng cho b.com
+	if err := request("b.com:443"); !errors.Is(err, errInvalidCredentials) {
+		t.Fatalf("b.com: got %v, want denied", err)
+	}
+	if got := atomic.LoadInt64(&calls); got != 2 {
+		t.Fatalf("got %d callback calls, want 2", got)
+	}
+}
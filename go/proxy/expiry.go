@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expirationLayouts là các định dạng hạn token mà nhà cung cấp có thể trả về
+var expirationLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"15:04:05 02/01/2006",
+	"15:04 02/01/2006",
+	"02/01/2006 15:04:05",
+	"02/01/2006 15:04",
+	"02/01/2006",
+	"02-01-2006 15:04:05",
+	"02-01-2006",
+}
+
+// parseExpiration chuyển chuỗi hạn token sang thời gian theo múi giờ máy chủ,
+// chấp nhận cả unix timestamp (giây)
+func parseExpiration(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	for _, layout := range expirationLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized expiration date %q", value)
+}
+
+// Expired cho biết key của proxy đã hết hạn
+func (p *Proxy) Expired() bool {
+	return p.expiredAt(time.Now())
+}
+
+func (p *Proxy) expiredAt(now time.Time) bool {
+	return !p.ExpiresAt.IsZero() && now.After(p.ExpiresAt)
+}
+
+// ExpiringKey là một key sắp hoặc đã hết hạn
+type ExpiringKey struct {
+	KeyID      string      `json:"key_id"`
+	Carrier    string      `json:"carrier,omitempty"`
+	Location   string      `json:"location,omitempty"`
+	Expiration string      `json:"expiration"`
+	ExpiresAt  time.Time   `json:"expires_at"`
+	Remaining  string      `json:"remaining"`
+	Expired    bool        `json:"expired"`
+	Types      []ProxyType `json:"types"`
+}
+
+// ExpiringKeys trả về các key hết hạn trong khoảng within (kể cả key đã hết hạn), sắp xếp theo hạn.
+// KeyID đã được che để đưa ra admin server.
+func (pm *ProxyManager) ExpiringKeys(within time.Duration) []ExpiringKey {
+	keys := pm.expiringKeys(within)
+	for i := range keys {
+		keys[i].KeyID = maskKey(keys[i].KeyID)
+	}
+	return keys
+}
+
+// expiringKeys giống ExpiringKeys nhưng giữ KeyID gốc để phân biệt các key có phần che trùng nhau
+func (pm *ProxyManager) expiringKeys(within time.Duration) []ExpiringKey {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	now := time.Now()
+	byKey := make(map[string]*ExpiringKey)
+	var keys []*ExpiringKey
+	for _, p := range pm.proxies {
+		if p.KeyID == "" || p.ExpiresAt.IsZero() || p.ExpiresAt.Sub(now) > within {
+			continue
+		}
+
+		key, exists := byKey[p.KeyID]
+		if !exists {
+			key = &ExpiringKey{
+				KeyID:      p.KeyID,
+				Carrier:    p.Carrier,
+				Location:   p.Location,
+				Expiration: p.Expiration,
+				ExpiresAt:  p.ExpiresAt,
+				Remaining:  p.ExpiresAt.Sub(now).Round(time.Minute).String(),
+				Expired:    now.After(p.ExpiresAt),
+			}
+			byKey[p.KeyID] = key
+			keys = append(keys, key)
+		}
+		key.Types = append(key.Types, p.Type)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ExpiresAt.Before(keys[j].ExpiresAt)
+	})
+
+	result := make([]ExpiringKey, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, *key)
+	}
+	return result
+}
+
+// WatchExpiry định kỳ ghi cảnh báo khi key còn ít hơn từng mốc leadTimes trước khi hết hạn
+// và khi key đã hết hạn; mỗi mốc chỉ cảnh báo một lần cho mỗi key
+func (pm *ProxyManager) WatchExpiry(leadTimes []time.Duration, interval time.Duration) {
+	leads := append([]time.Duration(nil), leadTimes...)
+	sort.Slice(leads, func(i, j int) bool { return leads[i] > leads[j] })
+
+	var horizon time.Duration
+	if len(leads) > 0 {
+		horizon = leads[0]
+	}
+
+	// warned lưu mốc nhỏ nhất đã cảnh báo của mỗi key, 0 nghĩa là đã báo hết hạn
+	warned := make(map[string]time.Duration)
+
+	check := func() {
+		// warned và active theo KeyID gốc, chỉ che key khi ghi log
+		keys := pm.expiringKeys(horizon)
+		active := make(map[string]bool)
+		for _, key := range keys {
+			active[key.KeyID] = true
+			last, exists := warned[key.KeyID]
+
+			if key.Expired {
+				if !exists || last > 0 {
+					logger.Warn("Key %s expired at %s, no longer selected", maskKey(key.KeyID), key.ExpiresAt.Format(time.RFC3339))
+					warned[key.KeyID] = 0
+				}
+				continue
+			}
+
+			// Chỉ cảnh báo mốc nhỏ nhất mà key đã vượt qua
+			remaining := time.Until(key.ExpiresAt)
+			var crossed time.Duration
+			for _, lead := range leads {
+				if remaining <= lead {
+					crossed = lead
+				}
+			}
+			if crossed > 0 && (!exists || crossed < last) {
+				logger.Warn("Key %s (%s %s) expires in %s at %s", maskKey(key.KeyID), key.Carrier, key.Location, key.Remaining, key.ExpiresAt.Format(time.RFC3339))
+				warned[key.KeyID] = crossed
+			}
+		}
+
+		// Quên các key đã gia hạn hoặc không còn trong pool
+		for keyID := range warned {
+			if !active[keyID] {
+				delete(warned, keyID)
+			}
+		}
+
+		if len(keys) > 0 {
+			logger.Info("Key expiry summary: %d key(s) expiring within %v or already expired", len(keys), horizon)
+		}
+	}
+
+	check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		check()
+	}
+}
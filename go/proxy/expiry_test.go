@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiringKeysDistinguishesShortKeys(t *testing.T) {
+	pm := NewProxyManager()
+	expiresAt := time.Now().Add(time.Hour)
+	for i, keyID := range []string{"short-a", "short-b"} {
+		pm.AddProxy(&Proxy{
+			URL:       "http://10.0.0." + string(rune('1'+i)) + ":8080",
+			Type:      ProxyTypeHTTP,
+			KeyID:     keyID,
+			ExpiresAt: expiresAt,
+			IsWorking: true,
+		})
+	}
+
+	keys := pm.expiringKeys(2 * time.Hour)
+	if len(keys) != 2 || keys[0].KeyID == keys[1].KeyID {
+		t.Fatalf("expected two distinct raw keys, got %+v", keys)
+	}
+
+	for _, key := range pm.ExpiringKeys(2 * time.Hour) {
+		if key.KeyID != "****" {
+			t.Fatalf("admin output not masked: %q", key.KeyID)
+		}
+	}
+}
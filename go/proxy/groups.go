@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// HealthCheckConfig là cấu hình kiểm tra sức khỏe upstream của một group
+type HealthCheckConfig struct {
+	URL      string `json:"url"`
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+}
+
+// GroupConfig là một phần tử trong file cấu hình group upstream
+type GroupConfig struct {
+	Name string `json:"name"`
+
+	// Thành viên: proxy có tag trùng tên group hoặc một trong Tags (gán từ cấu hình nguồn),
+	// hoặc khớp mọi điều kiện metadata được khai báo
+	Tags      []string  `json:"tags"`
+	Carriers  []string  `json:"carrier"`
+	Locations []string  `json:"location"`
+	Sources   []string  `json:"source"`
+	Type      ProxyType `json:"type"`
+
+	// Chính sách riêng của group, bỏ trống thì dùng mặc định của ProxyManager
+	Retries       *int              `json:"retries"`
+	FailThreshold int               `json:"fail_threshold"`
+	Strategy      string            `json:"strategy"`
+	HealthCheck   HealthCheckConfig `json:"health_check"`
+}
+
+// ProxyGroup là một group upstream có tên và chính sách riêng
+type ProxyGroup struct {
+	GroupConfig
+	strategy      Strategy
+	checkInterval time.Duration
+	checkTimeout  time.Duration
+}
+
+// NewProxyGroup kiểm tra cấu hình và tạo group
+func NewProxyGroup(cfg GroupConfig) (*ProxyGroup, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("group requires name")
+	}
+
+	g := &ProxyGroup{GroupConfig: cfg}
+	if cfg.Strategy != "" {
+		strategy, err := NewStrategy(cfg.Strategy)
+		if err != nil {
+			return nil, err
+		}
+		g.strategy = strategy
+	}
+
+	if cfg.HealthCheck.Interval != "" {
+		interval, err := time.ParseDuration(cfg.HealthCheck.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check interval %q: %v", cfg.HealthCheck.Interval, err)
+		}
+		g.checkInterval = interval
+	}
+	if cfg.HealthCheck.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.HealthCheck.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check timeout %q: %v", cfg.HealthCheck.Timeout, err)
+		}
+		g.checkTimeout = timeout
+	}
+
+	return g, nil
+}
+
+// Contains kiểm tra proxy có thuộc group không
+func (g *ProxyGroup) Contains(p *Proxy) bool {
+	if p.HasTag(g.Name) {
+		return true
+	}
+	for _, tag := range g.Tags {
+		if p.HasTag(tag) {
+			return true
+		}
+	}
+
+	// Không khai báo điều kiện metadata thì chỉ xét theo tag
+	if len(g.Carriers) == 0 && len(g.Locations) == 0 && len(g.Sources) == 0 && g.Type == "" {
+		return false
+	}
+	if len(g.Carriers) > 0 && !matchesAny(g.Carriers, p.Carrier) {
+		return false
+	}
+	if len(g.Locations) > 0 && !matchesAny(g.Locations, p.Location) {
+		return false
+	}
+	if len(g.Sources) > 0 && !containsString(g.Sources, p.Source) {
+		return false
+	}
+	if g.Type != "" && proxyTypeOf(p) != g.Type {
+		return false
+	}
+	return true
+}
+
+// matchesAny so sánh value với các giá trị đã chuẩn hóa như tùy chọn route
+func matchesAny(values []string, value string) bool {
+	value = normalizeRouteValue(value)
+	for _, v := range values {
+		if normalizeRouteValue(v) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadGroupsConfig đọc danh sách group upstream từ file JSON
+func LoadGroupsConfig(path string) ([]GroupConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read groups file: %v", err)
+	}
+
+	var configs []GroupConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse groups file: %v", err)
+	}
+	return configs, nil
+}
+
+// SetGroups thay thế danh sách group của ProxyManager
+func (pm *ProxyManager) SetGroups(groups []*ProxyGroup) {
+	byName := make(map[string]*ProxyGroup, len(groups))
+	for _, g := range groups {
+		byName[g.Name] = g
+	}
+
+	pm.groupsMu.Lock()
+	defer pm.groupsMu.Unlock()
+	pm.groups = byName
+	pm.groupOrder = append([]*ProxyGroup(nil), groups...)
+}
+
+// Group trả về group theo tên, nil nếu chưa cấu hình
+func (pm *ProxyManager) Group(name string) *ProxyGroup {
+	pm.groupsMu.RLock()
+	defer pm.groupsMu.RUnlock()
+	return pm.groups[name]
+}
+
+// inGroup kiểm tra proxy thuộc group; group chưa cấu hình được xét theo tag cùng tên.
+// Dùng groupsMu riêng nên gọi được khi đang giữ mu.
+func (pm *ProxyManager) inGroup(name string, p *Proxy) bool {
+	if g := pm.Group(name); g != nil {
+		return g.Contains(p)
+	}
+	return p.HasTag(name)
+}
+
+// groupsOf trả về các group đã cấu hình chứa proxy theo thứ tự trong file cấu hình
+func (pm *ProxyManager) groupsOf(p *Proxy) []*ProxyGroup {
+	pm.groupsMu.RLock()
+	defer pm.groupsMu.RUnlock()
+
+	var groups []*ProxyGroup
+	for _, g := range pm.groupOrder {
+		if g.Contains(p) {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// retriesFor trả về số lần thử lại cho request, theo group của request nếu có
+func (pm *ProxyManager) retriesFor(identity *Identity) int {
+	if g := pm.Group(identity.Route.Group); g != nil && g.Retries != nil {
+		return *g.Retries
+	}
+	return pm.maxRetries
+}
+
+// failThresholdFor trả về số lần lỗi liên tiếp trước khi proxy bị cách ly. Proxy thuộc nhiều
+// group dùng ngưỡng của group đầu tiên (theo thứ tự trong file cấu hình) có đặt fail_threshold.
+func (pm *ProxyManager) failThresholdFor(p *Proxy) int {
+	for _, g := range pm.groupsOf(p) {
+		if g.FailThreshold > 0 {
+			return g.FailThreshold
+		}
+	}
+	return pm.failThreshold
+}
+
+// healthCheckFor trả về target, chu kỳ và timeout kiểm tra proxy. Mỗi giá trị lấy từ group đầu
+// tiên (theo thứ tự trong file cấu hình) chứa proxy có đặt giá trị đó, không có thì dùng options.
+func (pm *ProxyManager) healthCheckFor(p *Proxy, options HealthCheckOptions) ([]string, time.Duration, time.Duration) {
+	var targets []string
+	var interval, timeout time.Duration
+	for _, g := range pm.groupsOf(p) {
+		if targets == nil && g.HealthCheck.URL != "" {
+			targets = []string{g.HealthCheck.URL}
+		}
+		if interval == 0 {
+			interval = g.checkInterval
+		}
+		if timeout == 0 {
+			timeout = g.checkTimeout
+		}
+	}
+	if targets == nil {
+		targets = options.Targets
+	}
+	if interval <= 0 {
+		interval = options.Interval
+	}
+	if timeout <= 0 {
+		timeout = options.Timeout
+	}
+	return targets, interval, timeout
+}
+
+// GroupStatus là tình trạng của một group upstream
+type GroupStatus struct {
+	Name          string            `json:"name"`
+	Members       int               `json:"members"`
+	Working       int               `json:"working"`
+	Retries       int               `json:"retries"`
+	FailThreshold int               `json:"fail_threshold"`
+	Strategy      string            `json:"strategy"`
+	HealthCheck   HealthCheckConfig `json:"health_check"`
+}
+
+// GroupStatuses trả về tình trạng của các group đã cấu hình
+func (pm *ProxyManager) GroupStatuses() []GroupStatus {
+	pm.groupsMu.RLock()
+	groups := make([]*ProxyGroup, 0, len(pm.groups))
+	for _, g := range pm.groups {
+		groups = append(groups, g)
+	}
+	pm.groupsMu.RUnlock()
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	now := time.Now()
+	statuses := make([]GroupStatus, 0, len(groups))
+	for _, g := range groups {
+		status := GroupStatus{
+			Name:          g.Name,
+			Retries:       pm.maxRetries,
+			FailThreshold: pm.failThreshold,
+			Strategy:      pm.strategy.Name(),
+			HealthCheck:   g.HealthCheck,
+		}
+		if g.Retries != nil {
+			status.Retries = *g.Retries
+		}
+		if g.FailThreshold > 0 {
+			status.FailThreshold = g.FailThreshold
+		}
+		if g.strategy != nil {
+			status.Strategy = g.strategy.Name()
+		}
+		for _, p := range pm.proxies {
+			if g.Contains(p) {
+				status.Members++
+				if pm.usable(p, now) {
+					status.Working++
+				}
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
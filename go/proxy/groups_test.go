@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func mustGroup(t *testing.T, cfg GroupConfig) *ProxyGroup {
+	t.Helper()
+	g, err := NewProxyGroup(cfg)
+	if err != nil {
+		t.Fatalf("NewProxyGroup(%s): %v", cfg.Name, err)
+	}
+	return g
+}
+
+func TestGroupPolicyOverridesDefaults(t *testing.T) {
+	pm := NewProxyManager()
+	pm.SetGroups([]*ProxyGroup{mustGroup(t, GroupConfig{
+		Name:          "slow",
+		FailThreshold: 10,
+		HealthCheck:   HealthCheckConfig{Interval: "5m", Timeout: "30s"},
+	})})
+
+	member := &Proxy{URL: "http://10.0.0.1:8080", Tags: []string{"slow"}}
+	if got := pm.failThresholdFor(member); got != 10 {
+		t.Fatalf("fail threshold = %d, want group value 10 above the default", got)
+	}
+	_, interval, timeout := pm.healthCheckFor(member, pm.healthCheck)
+	if interval != 5*time.Minute || timeout != 30*time.Second {
+		t.Fatalf("health check = %v/%v, want 5m/30s", interval, timeout)
+	}
+
+	other := &Proxy{URL: "http://10.0.0.2:8080"}
+	if got := pm.failThresholdFor(other); got != pm.failThreshold {
+		t.Fatalf("fail threshold outside groups = %d, want default %d", got, pm.failThreshold)
+	}
+	targets, interval, timeout := pm.healthCheckFor(other, pm.healthCheck)
+	if len(targets) != 1 || targets[0] != pm.healthCheck.Targets[0] || interval != pm.healthCheck.Interval || timeout != pm.healthCheck.Timeout {
+		t.Fatalf("health check outside groups = %v %v %v, want defaults", targets, interval, timeout)
+	}
+}
+
+func TestGroupPolicyFirstGroupWins(t *testing.T) {
+	pm := NewProxyManager()
+	pm.SetGroups([]*ProxyGroup{
+		mustGroup(t, GroupConfig{Name: "a", HealthCheck: HealthCheckConfig{Interval: "10m"}}),
+		mustGroup(t, GroupConfig{Name: "b", FailThreshold: 8, HealthCheck: HealthCheckConfig{URL: "http://b.example/check", Interval: "1m"}}),
+		mustGroup(t, GroupConfig{Name: "c", FailThreshold: 2, HealthCheck: HealthCheckConfig{URL: "http://c.example/check"}}),
+	})
+
+	p := &Proxy{URL: "http://10.0.0.1:8080", Tags: []string{"c", "b", "a"}}
+	for i := 0; i < 20; i++ {
+		if got := pm.failThresholdFor(p); got != 8 {
+			t.Fatalf("fail threshold = %d, want 8 from the first group that sets it", got)
+		}
+		targets, interval, _ := pm.healthCheckFor(p, pm.healthCheck)
+		if len(targets) != 1 || targets[0] != "http://b.example/check" {
+			t.Fatalf("targets = %v, want the URL of group b", targets)
+		}
+		if interval != 10*time.Minute {
+			t.Fatalf("interval = %v, want 10m from group a", interval)
+		}
+	}
+}
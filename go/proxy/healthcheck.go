@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HealthCheckOptions cấu hình bộ kiểm tra sức khỏe chủ động của pool
+type HealthCheckOptions struct {
+	// Targets là các URL kiểm tra, proxy phải qua được tất cả. URL http:// được gửi qua proxy HTTP
+	// như request thường, URL https:// được kiểm tra qua CONNECT rồi bắt tay TLS;
+	// proxy SOCKS5 mở tunnel tới đích trong cả hai trường hợp.
+	Targets  []string
+	Interval time.Duration
+	Timeout  time.Duration
+	Workers  int
+	// Jitter là độ lệch ngẫu nhiên tối đa cộng vào mỗi lần hẹn kiểm tra để tránh dồn probe
+	Jitter time.Duration
+	// ExpectStatus là các mã trạng thái chấp nhận, rỗng nghĩa là mọi mã 2xx
+	ExpectStatus []int
+	// ExpectBody là chuỗi phải có trong body phản hồi (đọc tối đa maxProbeBody byte)
+	ExpectBody string
+}
+
+// healthCheckResolution là chu kỳ bộ lập lịch tìm proxy đến hạn kiểm tra
+const healthCheckResolution = time.Second
+
+// maxProbeBody giới hạn số byte body đọc khi so ExpectBody
+const maxProbeBody = 64 * 1024
+
+// SetHealthCheckOptions đặt cấu hình kiểm tra sức khỏe, giá trị 0 hoặc rỗng giữ mặc định
+func (pm *ProxyManager) SetHealthCheckOptions(options HealthCheckOptions) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if len(options.Targets) > 0 {
+		pm.healthCheck.Targets = options.Targets
+	}
+	if options.Interval > 0 {
+		pm.healthCheck.Interval = options.Interval
+	}
+	if options.Timeout > 0 {
+		pm.healthCheck.Timeout = options.Timeout
+	}
+	if options.Workers > 0 {
+		pm.healthCheck.Workers = options.Workers
+	}
+	pm.healthCheck.Jitter = options.Jitter
+	pm.healthCheck.ExpectStatus = options.ExpectStatus
+	pm.healthCheck.ExpectBody = options.ExpectBody
+}
+
+func (pm *ProxyManager) healthCheckOptions() HealthCheckOptions {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.healthCheck
+}
+
+// StartHealthChecker kiểm tra định kỳ mọi proxy trong pool bằng một nhóm worker cố định.
+// Mỗi proxy được hẹn lại sau interval của nó (interval của group nếu có) cộng jitter;
+// proxy mới vào pool được kiểm tra trong khoảng jitter đầu tiên, proxy đang cách ly được
+// probe lại khi hết backoff.
+func (pm *ProxyManager) StartHealthChecker() {
+	options := pm.healthCheckOptions()
+	logger.Info("Health checker started: %d workers, interval %v, targets %s",
+		options.Workers, options.Interval, strings.Join(options.Targets, ", "))
+
+	jobs := make(chan *Proxy)
+	done := make(chan *Proxy)
+	for i := 0; i < options.Workers; i++ {
+		go func() {
+			for p := range jobs {
+				pm.checkProxy(p, options)
+				done <- p
+			}
+		}()
+	}
+
+	next := make(map[*Proxy]time.Time)
+	inFlight := make(map[*Proxy]bool)
+	var queue []*Proxy
+
+	ticker := time.NewTicker(healthCheckResolution)
+	defer ticker.Stop()
+
+	for {
+		// Chỉ gửi job khi hàng đợi có proxy, để worker luôn trả kết quả được
+		var send chan *Proxy
+		var head *Proxy
+		if len(queue) > 0 {
+			send = jobs
+			head = queue[0]
+		}
+
+		select {
+		case now := <-ticker.C:
+			pm.mu.RLock()
+			proxies := make([]*Proxy, len(pm.proxies))
+			copy(proxies, pm.proxies)
+			// Proxy đang cách ly được probe lại theo backoff thay vì theo interval
+			retryAt := make(map[*Proxy]time.Time)
+			pm.mu.RUnlock()
+			for _, p := range proxies {
+				if p.loadStatus() != statusDown {
+					continue
+				}
+				p.mu.Lock()
+				if p.state() == ProxyStateQuarantined {
+					retryAt[p] = p.RetryAt
+				}
+				p.mu.Unlock()
+			}
+
+			current := make(map[*Proxy]bool, len(proxies))
+			for _, p := range proxies {
+				current[p] = true
+				due, scheduled := next[p]
+				if retry, quarantined := retryAt[p]; quarantined {
+					due, scheduled = retry, true
+				}
+				if !scheduled {
+					next[p] = now.Add(jitter(options.Jitter))
+					continue
+				}
+				if !inFlight[p] && !now.Before(due) {
+					inFlight[p] = true
+					queue = append(queue, p)
+				}
+			}
+
+			// Quên các proxy đã bị gỡ khỏi pool
+			for p := range next {
+				if !current[p] && !inFlight[p] {
+					delete(next, p)
+				}
+			}
+		case send <- head:
+			queue = queue[1:]
+		case p := <-done:
+			delete(inFlight, p)
+			_, interval, _ := pm.healthCheckFor(p, options)
+			next[p] = time.Now().Add(interval + jitter(options.Jitter))
+		}
+	}
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// checkProxy kiểm tra proxy với mọi target và ghi nhận kết quả
+func (pm *ProxyManager) checkProxy(proxy *Proxy, options HealthCheckOptions) {
+	targets, _, timeout := pm.healthCheckFor(proxy, options)
+
+	var probeErr error
+	for _, target := range targets {
+		if probeErr = probeProxy(proxy, target, timeout, options); probeErr != nil {
+			probeErr = fmt.Errorf("%s: %v", target, probeErr)
+			break
+		}
+	}
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	// Proxy có thể đã được thay bằng bản cập nhật trong lúc probe: ghi kết quả vào bản đang
+	// trong pool, bỏ kết quả nếu proxy đã bị gỡ hoặc đã xoay sang URL khác
+	current := pm.proxyByID(proxy.ID())
+	if current == nil || current.URL != proxy.URL {
+		return
+	}
+	proxy = current
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	proxy.LastChecked = time.Now()
+	if probeErr != nil {
+		proxy.LastCheckError = probeErr.Error()
+		pm.recordFailure(proxy, true, "health check failed: "+probeErr.Error())
+		return
+	}
+
+	proxy.LastCheckError = ""
+	pm.recordSuccess(proxy, true)
+}
+
+// probeProxy gửi một request kiểm tra tới target qua proxy trong thời hạn timeout
+func probeProxy(proxy *Proxy, target string, timeout time.Duration, options HealthCheckOptions) error {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target: %v", err)
+	}
+	secure := targetURL.Scheme == "https"
+	defaultPort := 80
+	if secure {
+		defaultPort = 443
+	}
+	host, port := splitTarget(targetURL.Host, defaultPort)
+
+	deadline := time.Now().Add(timeout)
+	conn, err := dialProxy(proxy, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	request, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	request.Close = true
+
+	// Proxy HTTP với target http:// nhận request dạng absolute-form như client thường
+	if proxyTypeOf(proxy) == ProxyTypeHTTP && !secure {
+		if proxy.Username != "" && proxy.Password != "" {
+			auth := base64.StdEncoding.EncodeToString([]byte(proxy.Username + ":" + proxy.Password))
+			request.Header.Set("Proxy-Authorization", "Basic "+auth)
+		}
+		if err := request.WriteProxy(conn); err != nil {
+			return fmt.Errorf("failed to send request: %v", err)
+		}
+		return checkProbeResponse(conn, request, options)
+	}
+
+	// Các trường hợp còn lại mở tunnel: CONNECT với proxy HTTP, lệnh CONNECT với proxy SOCKS4/SOCKS5
+	if err := openTunnel(conn, proxy, host, port); err != nil {
+		return err
+	}
+
+	var tunnel net.Conn = conn
+	if secure {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake failed: %v", err)
+		}
+		tunnel = tlsConn
+	}
+
+	if err := request.Write(tunnel); err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+	return checkProbeResponse(tunnel, request, options)
+}
+
+// checkProbeResponse đọc phản hồi và so với mã trạng thái, nội dung mong đợi
+func checkProbeResponse(conn net.Conn, request *http.Request, options HealthCheckOptions) error {
+	resp, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if !expectedStatus(resp.StatusCode, options.ExpectStatus) {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	if options.ExpectBody != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+		if err != nil {
+			return fmt.Errorf("failed to read response body: %v", err)
+		}
+		if !strings.Contains(string(body), options.ExpectBody) {
+			return fmt.Errorf("response body does not contain %q", options.ExpectBody)
+		}
+	}
+	return nil
+}
+
+func expectedStatus(code int, expected []int) bool {
+	if len(expected) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, c := range expected {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
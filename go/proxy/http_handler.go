@@ -3,16 +3,18 @@ package proxy
 import (
 	"bufio"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // handleHTTPProxy xử lý các yêu cầu HTTP proxy với tự động thử lại
-func handleHTTPProxy(clientConn net.Conn, reader *bufio.Reader, firstLine string, pm *ProxyManager) {
+func handleHTTPProxy(clientConn net.Conn, reader *bufio.Reader, firstLine string, pm *ProxyManager, strategy Strategy) {
 	logger.Info("Handling HTTP proxy request: %s", firstLine)
 
 	// Lưu trữ tất cả headers để tái sử dụng khi thử lại
@@ -49,11 +51,27 @@ func handleHTTPProxy(clientConn net.Conn, reader *bufio.Reader, firstLine string
 	}
 
 	// Kiểm tra xác thực
-	if ok, err := checkAuth(headers); !ok {
+	identity, err := checkAuth(headers, "http", remoteIP(clientConn), host)
+	if err != nil {
 		logger.Error("Authentication failed: %v", err)
+		var lockedErr *authLockedError
+		if errors.As(err, &lockedErr) {
+			clientConn.Write([]byte(fmt.Sprintf("HTTP/1.1 429 Too Many Requests\r\nRetry-After: %d\r\n\r\n", lockedErr.retryAfter())))
+			return
+		}
 		clientConn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"Proxy Authentication Required\"\r\n\r\n"))
 		return
 	}
+	logger.Info("Authenticated user %s", identity.Username)
+	pm.resolveSession(identity, headerValue(headers, sessionHeader), remoteIP(clientConn))
+
+	// Kiểm tra quota của user
+	if err := beginQuotaRequest(identity); err != nil {
+		logger.Error("Rejecting request from user %s: %v", identity.Username, err)
+		clientConn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\nQuota exceeded\r\n"))
+		return
+	}
+	clientConn = meterConn(clientConn, identity)
 
 	// Trích xuất URL đích từ dòng đầu tiên
 	parts := strings.Split(firstLine, " ")
@@ -77,28 +95,64 @@ func handleHTTPProxy(clientConn net.Conn, reader *bufio.Reader, firstLine string
 		host = parsedURL.Host
 	}
 
-	// Theo dõi các proxy đã thử để tránh dùng lại chúng khi thử lại
-	triedProxies := make(map[string]bool)
-	var lastError error
-	var lastProxy *Proxy
-
 	// Chỉ chọn proxy HTTP
 	httpOnlySelector := func(p *Proxy) bool {
 		return p.Type == ProxyTypeHTTP || p.Type == ProxyTypeUnknown
 	}
 
-	// Thử tối đa maxRetries lần
-	for retry := 0; retry <= pm.maxRetries; retry++ {
-		var proxy *Proxy
-		if retry == 0 {
-			proxy = pm.GetRandomProxyWithFilter(httpOnlySelector)
-		} else {
-			var excludeURL string
-			if lastProxy != nil {
-				excludeURL = lastProxy.URL
+	// Áp dụng rule định tuyến theo đích
+	targetHost, targetPort := splitTarget(host, 80)
+	if rule := matchRule(identity, targetHost, targetPort); rule != nil {
+		switch {
+		case rule.Action == RuleActionReject:
+			clientConn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\nBlocked by routing rule\r\n"))
+			return
+		case rule.Action == RuleActionDirect:
+			upstream, err := net.DialTimeout("tcp", net.JoinHostPort(targetHost, strconv.Itoa(targetPort)), 10*time.Second)
+			if err != nil {
+				logger.Error("Failed to connect directly to %s: %v", host, err)
+				clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+				return
+			}
+			defer upstream.Close()
+			if err := forwardHTTPRequest(clientConn, reader, upstream, method, targetURL, headers); err != nil {
+				logger.Error("Direct HTTP request to %s failed: %v", host, err)
 			}
-			proxy = pm.GetNextWorkingProxyWithFilter(excludeURL, httpOnlySelector)
+			return
+		case rule.Action == RuleActionType && rule.Type != ProxyTypeHTTP:
+			upstream, proxy, err := pm.dialTunnel(identity, rule.selector(func(*Proxy) bool { return true }), strategy, targetHost, targetPort)
+			if err != nil {
+				logger.Error("Failed to reach %s via %s upstream: %v", host, rule.Type, err)
+				clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+				return
+			}
+			defer upstream.Close()
+			defer pm.TrackConnection(proxy)()
+			upstream, finishTransfer := pm.TrackTransfer(proxy, upstream)
+			defer finishTransfer()
+			logger.Info("Sending %s %s via %s proxy %s", method, targetURL, rule.Type, proxy.Describe())
+			if err := forwardHTTPRequest(clientConn, reader, upstream, method, targetURL, headers); err != nil {
+				logger.Error("HTTP request via %s failed: %v", proxy.Redacted(), err)
+			}
+			return
+		default:
+			httpOnlySelector = rule.apply(identity, httpOnlySelector)
+		}
+	}
+
+	// Theo dõi các proxy đã thử để tránh dùng lại chúng khi thử lại
+	triedProxies := make(map[string]bool)
+	var lastError error
+	var lastProxy *Proxy
+
+	// Thử tối đa maxRetries lần (theo group của request nếu có)
+	maxRetries := pm.retriesFor(identity)
+	for retry := 0; retry <= maxRetries; retry++ {
+		var excludeURL string
+		if lastProxy != nil {
+			excludeURL = lastProxy.URL
 		}
+		proxy := pm.GetProxyForRoute(identity, excludeURL, httpOnlySelector, strategy)
 
 		if proxy == nil {
 			logger.Error("No more available HTTP proxies to try after %d attempts", retry)
@@ -107,7 +161,7 @@ func handleHTTPProxy(clientConn net.Conn, reader *bufio.Reader, firstLine string
 		}
 
 		if retry > 0 {
-			logger.Info("HTTP Retry %d/%d with proxy %s", retry, pm.maxRetries, proxy.URL)
+			logger.Info("HTTP Retry %d/%d with proxy %s", retry, maxRetries, proxy.Redacted())
 		}
 
 		// Bỏ qua nếu đã thử proxy này
@@ -119,31 +173,23 @@ func handleHTTPProxy(clientConn net.Conn, reader *bufio.Reader, firstLine string
 		triedProxies[proxy.URL] = true
 		lastProxy = proxy
 
-		proxyURL, err := url.Parse(proxy.URL)
-		if err != nil {
-			logger.Error("Failed to parse proxy URL: %v", err)
-			lastError = err
-			pm.MarkProxyFailed(proxy)
-			continue // Thử proxy tiếp theo
-		}
-
-		// Thiết lập xác thực proxy trong URL nếu có thông tin đăng nhập
-		if proxy.Username != "" && proxy.Password != "" {
-			proxyURL.User = url.UserPassword(proxy.Username, proxy.Password)
-		}
-
 		// Kết nối tới proxy với timeout
-		proxyConn, err := net.DialTimeout("tcp", proxyURL.Host, 10*time.Second)
+		dialStart := time.Now()
+		proxyConn, err := dialProxy(proxy, 10*time.Second)
 		if err != nil {
-			logger.Error("Failed to connect to proxy: %v", err)
+			logger.Error("Failed to connect to proxy %s: %v", proxy.Redacted(), err)
 			lastError = err
 			pm.MarkProxyFailed(proxy)
 			continue // Thử proxy tiếp theo
 		}
+		pm.ObserveLatency(proxy, time.Since(dialStart))
+		proxyConn, finishTransfer := pm.TrackTransfer(proxy, proxyConn)
 
 		// Sử dụng defer trong một hàm để đảm bảo kết nối này được đóng trước khi thử proxy khác
 		func() {
 			defer proxyConn.Close()
+			defer pm.TrackConnection(proxy)()
+			defer finishTransfer()
 
 			// Xây dựng request
 			var request strings.Builder
@@ -158,7 +204,7 @@ func handleHTTPProxy(clientConn net.Conn, reader *bufio.Reader, firstLine string
 
 			// Thêm các header còn lại
 			for key, value := range headers {
-				if key != "Host" && key != "Proxy-Authorization" {
+				if key != "Host" && key != "Proxy-Authorization" && !strings.EqualFold(key, sessionHeader) {
 					request.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
 				}
 			}
@@ -166,7 +212,7 @@ func handleHTTPProxy(clientConn net.Conn, reader *bufio.Reader, firstLine string
 			// Thêm header Connection
 			request.WriteString("Connection: Keep-Alive\r\n\r\n")
 
-			logger.Info("Sending request to proxy: %s", request.String())
+			logger.Info("Sending %s %s to proxy %s", method, targetURL, proxy.Redacted())
 
 			// Gửi request tới proxy với timeout
 			if err := proxyConn.SetWriteDeadline(time.Now().Add(5 * time.Second)); err != nil {
@@ -222,6 +268,9 @@ func handleHTTPProxy(clientConn net.Conn, reader *bufio.Reader, firstLine string
 				return // Thử proxy tiếp theo
 			}
 
+			// Proxy đã phản hồi hợp lệ, ghi nhận thành công ngay mà không chờ hết phản hồi
+			pm.MarkProxySuccess(proxy)
+
 			// Phần đầu tiên của phản hồi trông tốt, gửi nó cho client
 			if _, err := clientConn.Write(respBuf[:n]); err != nil {
 				logger.Error("Failed to write to client: %v", err)
@@ -249,10 +298,7 @@ func handleHTTPProxy(clientConn net.Conn, reader *bufio.Reader, firstLine string
 				}
 			}
 
-			logger.Info("HTTP request completed successfully. Total bytes: %d", totalBytes)
-
-			// Đánh dấu proxy này là thành công
-			pm.MarkProxySuccess(proxy)
+			logger.Info("HTTP request completed successfully via %s. Total bytes: %d", proxy.Describe(), totalBytes)
 
 			return
 		}()
@@ -264,6 +310,6 @@ func handleHTTPProxy(clientConn net.Conn, reader *bufio.Reader, firstLine string
 	}
 
 	// Nếu đến đây, tất cả các lần thử đều thất bại
-	logger.Error("All HTTP proxy attempts failed after %d retries, last error: %v", pm.maxRetries, lastError)
+	logger.Error("All HTTP proxy attempts failed after %d retries, last error: %v", maxRetries, lastError)
 	clientConn.Write([]byte(fmt.Sprintf("HTTP/1.1 502 Bad Gateway\r\n\r\nAll proxy attempts failed: %v\r\n", lastError)))
 }
@@ -3,16 +3,17 @@ package proxy
 import (
 	"bufio"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // handleHTTPSProxy xử lý các request HTTPS (CONNECT) proxy với tự động thử lại
-func handleHTTPSProxy(clientConn net.Conn, reader *bufio.Reader, firstLine string, pm *ProxyManager) {
+func handleHTTPSProxy(clientConn net.Conn, reader *bufio.Reader, firstLine string, pm *ProxyManager, strategy Strategy) {
 	logger.Info("Handling HTTPS proxy request: %s", firstLine)
 
 	// Trích xuất host từ dòng lệnh CONNECT
@@ -46,11 +47,27 @@ func handleHTTPSProxy(clientConn net.Conn, reader *bufio.Reader, firstLine strin
 	}
 
 	// Kiểm tra xác thực
-	if ok, err := checkAuth(headers); !ok {
+	identity, err := checkAuth(headers, "https", remoteIP(clientConn), hostPort)
+	if err != nil {
 		logger.Error("Authentication failed: %v", err)
+		var lockedErr *authLockedError
+		if errors.As(err, &lockedErr) {
+			clientConn.Write([]byte(fmt.Sprintf("HTTP/1.1 429 Too Many Requests\r\nRetry-After: %d\r\n\r\n", lockedErr.retryAfter())))
+			return
+		}
 		clientConn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"Proxy Authentication Required\"\r\n\r\n"))
 		return
 	}
+	logger.Info("Authenticated user %s", identity.Username)
+	pm.resolveSession(identity, headerValue(headers, sessionHeader), remoteIP(clientConn))
+
+	// Kiểm tra quota của user
+	if err := beginQuotaRequest(identity); err != nil {
+		logger.Error("Rejecting request from user %s: %v", identity.Username, err)
+		clientConn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\nQuota exceeded\r\n"))
+		return
+	}
+	clientConn = meterConn(clientConn, identity)
 
 	// Theo dõi các proxy đã thử để tránh dùng lại chúng khi thử lại
 	triedProxies := make(map[string]bool)
@@ -63,25 +80,56 @@ func handleHTTPSProxy(clientConn net.Conn, reader *bufio.Reader, firstLine strin
 		return p.Type == ProxyTypeHTTP || p.Type == ProxyTypeUnknown
 	}
 
-	// Thử tối đa maxRetries lần
-	for retry := 0; retry <= pm.maxRetries; retry++ {
-		// Lấy một proxy, loại trừ những proxy đã thử
-		var proxy *Proxy
-		if retry == 0 {
-			proxy = pm.GetRandomProxyWithFilter(httpOnlySelector)
-		} else {
-			var excludeURL string
-			if lastProxy != nil {
-				excludeURL = lastProxy.URL
+	// Áp dụng rule định tuyến theo đích
+	targetHost, targetPort := splitTarget(hostPort, 443)
+	if rule := matchRule(identity, targetHost, targetPort); rule != nil {
+		switch {
+		case rule.Action == RuleActionReject:
+			clientConn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\nBlocked by routing rule\r\n"))
+			return
+		case rule.Action == RuleActionDirect:
+			upstream, err := net.DialTimeout("tcp", net.JoinHostPort(targetHost, strconv.Itoa(targetPort)), 10*time.Second)
+			if err != nil {
+				logger.Error("Failed to connect directly to %s: %v", hostPort, err)
+				clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+				return
 			}
-			proxy = pm.GetNextWorkingProxyWithFilter(excludeURL, httpOnlySelector)
-			if proxy == nil {
-				logger.Error("No more available HTTP proxies to try after %d attempts", retry)
+			defer upstream.Close()
+			clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+			logger.Info("HTTPS tunnel established directly to %s", hostPort)
+			go copyData(clientConn, upstream)
+			copyData(upstream, clientConn)
+			return
+		case rule.Action == RuleActionType && rule.Type != ProxyTypeHTTP:
+			upstream, proxy, err := pm.dialTunnel(identity, rule.selector(func(*Proxy) bool { return true }), strategy, targetHost, targetPort)
+			if err != nil {
+				logger.Error("Failed to reach %s via %s upstream: %v", hostPort, rule.Type, err)
 				clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
 				return
 			}
-			logger.Info("HTTPS Retry %d/%d with proxy %s", retry, pm.maxRetries, proxy.URL)
+			defer upstream.Close()
+			defer pm.TrackConnection(proxy)()
+			upstream, finishTransfer := pm.TrackTransfer(proxy, upstream)
+			defer finishTransfer()
+			clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+			logger.Info("HTTPS tunnel established via %s proxy %s to %s", rule.Type, proxy.Describe(), hostPort)
+			go copyData(clientConn, upstream)
+			copyData(upstream, clientConn)
+			return
+		default:
+			httpOnlySelector = rule.apply(identity, httpOnlySelector)
 		}
+	}
+
+	// Thử tối đa maxRetries lần (theo group của request nếu có)
+	maxRetries := pm.retriesFor(identity)
+	for retry := 0; retry <= maxRetries; retry++ {
+		// Lấy một proxy, loại trừ những proxy đã thử
+		var excludeURL string
+		if lastProxy != nil {
+			excludeURL = lastProxy.URL
+		}
+		proxy := pm.GetProxyForRoute(identity, excludeURL, httpOnlySelector, strategy)
 
 		if proxy == nil {
 			logger.Error("No more available HTTP proxies to try after %d attempts", retry)
@@ -89,6 +137,10 @@ func handleHTTPSProxy(clientConn net.Conn, reader *bufio.Reader, firstLine strin
 			return
 		}
 
+		if retry > 0 {
+			logger.Info("HTTPS Retry %d/%d with proxy %s", retry, maxRetries, proxy.Redacted())
+		}
+
 		// Bỏ qua nếu đã thử proxy này
 		if triedProxies[proxy.URL] {
 			continue
@@ -98,22 +150,16 @@ func handleHTTPSProxy(clientConn net.Conn, reader *bufio.Reader, firstLine strin
 		triedProxies[proxy.URL] = true
 		lastProxy = proxy
 
-		proxyURL, err := url.Parse(proxy.URL)
-		if err != nil {
-			logger.Error("Failed to parse proxy URL: %v", err)
-			lastError = err
-			pm.MarkProxyFailed(proxy)
-			continue // Thử proxy tiếp theo
-		}
-
 		// Kết nối tới proxy với timeout
-		proxyConn, err := net.DialTimeout("tcp", proxyURL.Host, 10*time.Second)
+		dialStart := time.Now()
+		proxyConn, err := dialProxy(proxy, 10*time.Second)
 		if err != nil {
-			logger.Error("Failed to connect to proxy: %v", err)
+			logger.Error("Failed to connect to proxy %s: %v", proxy.Redacted(), err)
 			lastError = err
 			pm.MarkProxyFailed(proxy)
 			continue // Thử proxy tiếp theo
 		}
+		pm.ObserveLatency(proxy, time.Since(dialStart))
 
 		// Sử dụng defer trong một hàm để đảm bảo kết nối này được đóng trước khi thử proxy khác
 		tunnelEstablished := false
@@ -215,11 +261,14 @@ func handleHTTPSProxy(clientConn net.Conn, reader *bufio.Reader, firstLine strin
 			pm.MarkProxySuccess(proxy)
 
 			// Tạo tunnel giữa client và upstream server
-			logger.Info("HTTPS tunnel established via proxy %s to %s", proxy.URL, hostPort)
+			logger.Info("HTTPS tunnel established via proxy %s to %s", proxy.Describe(), hostPort)
 
 			// Xử lý truyền dữ liệu hai chiều
-			go copyData(clientConn, proxyConn)
-			copyData(proxyConn, clientConn)
+			defer pm.TrackConnection(proxy)()
+			tunnelConn, finishTransfer := pm.TrackTransfer(proxy, proxyConn)
+			defer finishTransfer()
+			go copyData(clientConn, tunnelConn)
+			copyData(tunnelConn, clientConn)
 
 			// Đóng kết nối sau khi kết thúc
 			proxyConn.Close()
@@ -228,7 +277,7 @@ func handleHTTPSProxy(clientConn net.Conn, reader *bufio.Reader, firstLine strin
 	}
 
 	// Nếu đến đây, tất cả các lần thử đều thất bại
-	logger.Error("All HTTPS proxy attempts failed after %d retries, last error: %v", pm.maxRetries, lastError)
+	logger.Error("All HTTPS proxy attempts failed after %d retries, last error: %v", maxRetries, lastError)
 	clientConn.Write([]byte(fmt.Sprintf("HTTP/1.1 502 Bad Gateway\r\n\r\nAll proxy attempts failed: %v\r\n", lastError)))
 }
 
@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// ttlCheckInterval là chu kỳ gỡ các proxy đã quá TTL khỏi pool
+const ttlCheckInterval = time.Minute
+
+// ID định danh proxy trong pool: theo key và loại proxy nếu có, nếu không theo URL.
+// Proxy của cùng key giữ nguyên ID khi key xoay sang IP/thông tin đăng nhập mới.
+func (p *Proxy) ID() string {
+	if p.KeyID != "" {
+		return p.KeyID + "/" + string(p.Type)
+	}
+	return p.URL
+}
+
+// stale cho biết proxy đã quá TTL kể từ lần cuối được nguồn trả về
+func (p *Proxy) stale(now time.Time) bool {
+	return p.TTL > 0 && now.Sub(p.RefreshedAt) > p.TTL
+}
+
+// updateServeUntil tính lại thời điểm proxy hết được chọn từ ExpiresAt và TTL (gọi khi đang giữ mu)
+func (p *Proxy) updateServeUntil() {
+	var until time.Time
+	if !p.ExpiresAt.IsZero() {
+		until = p.ExpiresAt
+	}
+	if p.TTL > 0 {
+		if staleAt := p.RefreshedAt.Add(p.TTL); until.IsZero() || staleAt.Before(until) {
+			until = staleAt
+		}
+	}
+	p.serveUntil = 0
+	if !until.IsZero() {
+		p.serveUntil = until.UnixNano()
+	}
+}
+
+// servable cho biết proxy chưa hết hạn và chưa quá TTL tại thời điểm now (unix nano)
+func (p *Proxy) servable(now int64) bool {
+	return p.serveUntil == 0 || now <= p.serveUntil
+}
+
+// AddProxy thêm proxy vào pool. Nếu pool đã có proxy cùng ID thì proxy đó được cập nhật
+// (thông tin đăng nhập, metadata, TTL) thay vì thêm bản trùng.
+func (pm *ProxyManager) AddProxy(proxy *Proxy) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.addProxy(proxy)
+}
+
+// addProxy thêm hoặc cập nhật proxy, trả về true nếu proxy mới được thêm (gọi khi đang giữ mu)
+func (pm *ProxyManager) addProxy(proxy *Proxy) bool {
+	if current := pm.proxyByID(proxy.ID()); current != nil {
+		if _, err := pm.updateProxy(current, proxy, nil); err != nil {
+			logger.Warn("Not updating proxy %s: %v", current.Describe(), err)
+		}
+		return false
+	}
+	if pm.hasURL(proxy.URL) {
+		return false
+	}
+
+	now := time.Now()
+	proxy.AddedAt = now
+	proxy.RefreshedAt = now
+	pm.insert(proxy)
+	return true
+}
+
+// insert đưa proxy vào pool và index (gọi khi đang giữ mu)
+func (pm *ProxyManager) insert(proxy *Proxy) {
+	proxy.mu.Lock()
+	proxy.publishStatus()
+	proxy.mu.Unlock()
+	proxy.updateServeUntil()
+
+	pm.proxies = append(pm.proxies, proxy)
+	pm.byID[proxy.ID()] = proxy
+	pm.byURL[proxy.URL] = proxy
+}
+
+// removeWhere gỡ khỏi pool các proxy thỏa remove, trả về số proxy bị gỡ (gọi khi đang giữ mu)
+func (pm *ProxyManager) removeWhere(remove func(*Proxy) bool) int {
+	removed := 0
+	kept := pm.proxies[:0]
+	for _, p := range pm.proxies {
+		if remove(p) {
+			delete(pm.byID, p.ID())
+			delete(pm.byURL, p.URL)
+			removed++
+			continue
+		}
+		kept = append(kept, p)
+	}
+	for i := len(kept); i < len(pm.proxies); i++ {
+		pm.proxies[i] = nil
+	}
+	pm.proxies = kept
+	return removed
+}
+
+// ReplaceProxy thay proxy có ID id bằng proxy mới, giữ thống kê nếu URL không đổi.
+// Trả về false nếu pool không có proxy với ID này, lỗi nếu ID hoặc URL mới đã thuộc về proxy khác.
+func (pm *ProxyManager) ReplaceProxy(id string, proxy *Proxy) (bool, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	current := pm.proxyByID(id)
+	if current == nil {
+		return false, nil
+	}
+	if _, err := pm.updateProxy(current, proxy, nil); err != nil {
+		return true, err
+	}
+	logger.Info("Replaced proxy %s", proxy.Describe())
+	return true, nil
+}
+
+// RemoveProxy gỡ proxy có ID id khỏi pool, kết nối đang mở qua proxy vẫn chạy tới khi đóng.
+// Trả về false nếu pool không có proxy với ID này.
+func (pm *ProxyManager) RemoveProxy(id string) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	target := pm.proxyByID(id)
+	if target == nil {
+		return false
+	}
+	pm.removeWhere(func(p *Proxy) bool { return p == target })
+	logger.Info("Removed proxy %s", target.Describe())
+	return true
+}
+
+// proxyByID tìm proxy theo ID (gọi khi đang giữ mu)
+func (pm *ProxyManager) proxyByID(id string) *Proxy {
+	return pm.byID[id]
+}
+
+// hasURL kiểm tra pool đã có proxy với URL này chưa (gọi khi đang giữ mu)
+func (pm *ProxyManager) hasURL(proxyURL string) bool {
+	_, exists := pm.byURL[proxyURL]
+	return exists
+}
+
+// updateProxy cập nhật proxy current trong pool theo dữ liệu mới nhất incoming (gọi khi đang giữ mu),
+// trả về true nếu key đã xoay sang IP/thông tin đăng nhập mới. Nếu ID hoặc URL mới đã thuộc về
+// proxy khác trong pool, current được giữ nguyên và trả về lỗi để index không bị ghi đè.
+//
+// URL, thông tin đăng nhập và metadata của proxy đã vào pool không bao giờ bị sửa tại chỗ vì
+// request đang chạy đọc chúng mà không giữ mu. Khi có thay đổi, một Proxy mới mang theo thống kê
+// của current được thay vào pool và index; request đang giữ current vẫn đọc bản cũ nguyên vẹn.
+// pending khác nil thì việc thay trong slice được gom lại để gọi replaceEntries một lần.
+func (pm *ProxyManager) updateProxy(current, incoming *Proxy, pending map[*Proxy]*Proxy) (bool, error) {
+	now := time.Now()
+	if sameEntry(current, incoming) {
+		// RefreshedAt và TTL chỉ được đọc khi giữ mu nên cập nhật tại chỗ được
+		current.TTL = incoming.TTL
+		current.RefreshedAt = now
+		current.updateServeUntil()
+		return false, nil
+	}
+
+	if other := pm.proxyByID(incoming.ID()); other != nil && other != current {
+		return false, fmt.Errorf("ID already used by proxy %s", other.Describe())
+	}
+	if other := pm.byURL[incoming.URL]; other != nil && other != current {
+		return false, fmt.Errorf("URL already used by proxy %s", other.Describe())
+	}
+
+	rotated := current.URL != incoming.URL
+	if rotated {
+		logger.Info("Proxy %s rotated to %s", current.Describe(), incoming.Redacted())
+	}
+
+	next := cloneEntry(incoming)
+	next.AddedAt = current.AddedAt
+	next.RefreshedAt = now
+	pm.carryStats(next, current, rotated)
+	next.updateServeUntil()
+
+	delete(pm.byID, current.ID())
+	delete(pm.byURL, current.URL)
+	pm.byID[next.ID()] = next
+	pm.byURL[next.URL] = next
+
+	if pending != nil {
+		pending[current] = next
+	} else {
+		pm.replaceEntries(map[*Proxy]*Proxy{current: next})
+	}
+	return rotated, nil
+}
+
+// replaceEntries thay các proxy trong slice của pool theo replacements (gọi khi đang giữ mu)
+func (pm *ProxyManager) replaceEntries(replacements map[*Proxy]*Proxy) {
+	if len(replacements) == 0 {
+		return
+	}
+	for i, p := range pm.proxies {
+		if next, exists := replacements[p]; exists {
+			pm.proxies[i] = next
+		}
+	}
+}
+
+// sameEntry cho biết hai proxy có cùng địa chỉ, thông tin đăng nhập và metadata
+func sameEntry(a, b *Proxy) bool {
+	return a.URL == b.URL && a.Username == b.Username && a.Password == b.Password &&
+		a.AuthHeader == b.AuthHeader && a.Type == b.Type && a.KeyID == b.KeyID &&
+		a.Carrier == b.Carrier && a.Location == b.Location && a.Expiration == b.Expiration &&
+		a.ExpiresAt.Equal(b.ExpiresAt) && a.Source == b.Source && a.Priority == b.Priority &&
+		a.Weight == b.Weight && slices.Equal(a.Tags, b.Tags)
+}
+
+// cloneEntry tạo Proxy mới chỉ gồm địa chỉ, thông tin đăng nhập, metadata và TTL của p
+func cloneEntry(p *Proxy) *Proxy {
+	return &Proxy{
+		URL:        p.URL,
+		Username:   p.Username,
+		Password:   p.Password,
+		AuthHeader: p.AuthHeader,
+		Type:       p.Type,
+		KeyID:      p.KeyID,
+		Carrier:    p.Carrier,
+		Location:   p.Location,
+		Expiration: p.Expiration,
+		ExpiresAt:  p.ExpiresAt,
+		Source:     p.Source,
+		Priority:   p.Priority,
+		Weight:     p.Weight,
+		Tags:       slices.Clone(p.Tags),
+		TTL:        p.TTL,
+	}
+}
+
+// carryStats chép bộ đếm, trạng thái sức khỏe và chỉ số của from sang proxy mới next trước khi
+// next vào pool (gọi khi đang giữ mu). Key đã xoay thì trạng thái lỗi và độ trễ cũ không còn đúng
+// nên được đặt lại. ActiveConns không được chép vì kết nối đang mở sẽ giảm bộ đếm của from.
+func (pm *ProxyManager) carryStats(next, from *Proxy, rotated bool) {
+	atomic.StoreInt64(&next.Requests, atomic.LoadInt64(&from.Requests))
+	atomic.StoreInt64(&next.Failures, atomic.LoadInt64(&from.Failures))
+	atomic.StoreInt64(&next.lastUsed, atomic.LoadInt64(&from.lastUsed))
+	atomic.StoreInt64(&next.trialSince, atomic.LoadInt64(&from.trialSince))
+
+	from.mu.Lock()
+	next.FailCount = from.FailCount
+	next.LastChecked = from.LastChecked
+	next.LastCheckError = from.LastCheckError
+	next.IsWorking = from.IsWorking
+	next.State = from.State
+	next.StateChanged = from.StateChanged
+	next.RetryAt = from.RetryAt
+	next.Backoff = from.Backoff
+	next.TrialSuccesses = from.TrialSuccesses
+	from.mu.Unlock()
+
+	next.mu.Lock()
+	defer next.mu.Unlock()
+	if rotated {
+		pm.resetState(next, "credentials rotated")
+		return
+	}
+	atomic.StoreInt64(&next.metrics.latency, atomic.LoadInt64(&from.metrics.latency))
+	atomic.StoreInt64(&next.metrics.ttfb, atomic.LoadInt64(&from.metrics.ttfb))
+	atomic.StoreUint64(&next.metrics.successRate, atomic.LoadUint64(&from.metrics.successRate))
+	atomic.StoreInt64(&next.metrics.samples, atomic.LoadInt64(&from.metrics.samples))
+	atomic.StoreUint64(&next.metrics.throughput, atomic.LoadUint64(&from.metrics.throughput))
+	next.publishStatus()
+}
+
+// retireStale gỡ các proxy đã quá TTL mà nguồn không trả về nữa (gọi khi đang giữ mu)
+func (pm *ProxyManager) retireStale(now time.Time) int {
+	return pm.removeWhere(func(p *Proxy) bool {
+		if !p.stale(now) {
+			return false
+		}
+		logger.Info("Retired proxy %s: not refreshed for %v (ttl %v)", p.Describe(), now.Sub(p.RefreshedAt).Round(time.Second), p.TTL)
+		return true
+	})
+}
+
+// RetireStaleProxies gỡ các proxy đã quá TTL, trả về số proxy bị gỡ
+func (pm *ProxyManager) RetireStaleProxies() int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.retireStale(time.Now())
+}
+
+// watchTTL định kỳ gỡ các proxy đã quá TTL
+func (pm *ProxyManager) watchTTL(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		pm.RetireStaleProxies()
+	}
+}
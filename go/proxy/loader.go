@@ -1,11 +1,9 @@
 package proxy
 
 import (
-	"bufio"
 	"fmt"
 	"log"
 	"os"
-	"strings"
 	"time"
 )
 
@@ -32,25 +30,19 @@ func LoadProxies(filename string, pm *ProxyManager) error {
 	return LoadProxiesWithType(filename, ProxyTypeHTTP, pm)
 }
 
-// LoadProxiesWithType tải proxy từ file với type xác định
+// LoadProxiesWithType tải proxy từ file với type xác định cho các dòng không ghi loại proxy.
+// File có thể là danh sách text, CSV, JSON hoặc YAML (theo phần mở rộng); mục sai định dạng
+// được ghi cảnh báo kèm số dòng và bỏ qua.
 func LoadProxiesWithType(filename string, proxyType ProxyType, pm *ProxyManager) error {
-	file, err := os.Open(filename)
+	list, err := ReadProxyListFile(filename, proxyType)
 	if err != nil {
-		return fmt.Errorf("failed to open proxy list file: %v", err)
+		return err
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
-			continue
-		}
-
-		proxy := &Proxy{
-			URL:  line,
-			Type: proxyType,
-		}
+	for _, entryErr := range list.Errors {
+		log.Printf("[WARN] Skipping invalid proxy in %s at %v", filename, entryErr)
+	}
+	for _, proxy := range list.Proxies {
 		pm.AddProxy(proxy)
 	}
 
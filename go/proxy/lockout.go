@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// authLockedError được trả về khi IP hoặc username đang bị khóa
+type authLockedError struct {
+	key       string
+	remaining time.Duration
+}
+
+func (e *authLockedError) Error() string {
+	return fmt.Sprintf("too many failed authentication attempts, %s locked for %v", e.key, e.remaining.Round(time.Second))
+}
+
+// retryAfter là giá trị header Retry-After (giây, làm tròn lên để client không thử lại quá sớm)
+func (e *authLockedError) retryAfter() int {
+	return int((e.remaining + time.Second - 1) / time.Second)
+}
+
+// lockoutEntry đếm số lần xác thực thất bại của một IP hoặc username
+type lockoutEntry struct {
+	failures    int
+	lockouts    int
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+// AuthLimiter khóa tạm thời IP/username đoán sai mật khẩu quá nhiều lần,
+// thời gian khóa tăng gấp đôi sau mỗi lần bị khóa
+type AuthLimiter struct {
+	maxFailures int
+	baseLockout time.Duration
+	maxLockout  time.Duration
+	mu          sync.Mutex
+	entries     map[string]*lockoutEntry
+}
+
+var authLimiter = NewAuthLimiter(5, time.Minute, time.Hour)
+
+// ConfigureAuthLimiter thay thế bộ giới hạn xác thực mặc định
+func ConfigureAuthLimiter(l *AuthLimiter) {
+	if l != nil {
+		authLimiter = l
+	}
+}
+
+// NewAuthLimiter tạo bộ giới hạn khóa sau maxFailures lần sai liên tiếp
+func NewAuthLimiter(maxFailures int, baseLockout, maxLockout time.Duration) *AuthLimiter {
+	return &AuthLimiter{
+		maxFailures: maxFailures,
+		baseLockout: baseLockout,
+		maxLockout:  maxLockout,
+		entries:     make(map[string]*lockoutEntry),
+	}
+}
+
+// Check trả về lỗi nếu một trong các key đang bị khóa
+func (l *AuthLimiter) Check(keys ...string) error {
+	for _, key := range keys {
+		if remaining, locked := l.Locked(key); locked {
+			return &authLockedError{key: key, remaining: remaining}
+		}
+	}
+	return nil
+}
+
+// Locked trả về thời gian còn bị khóa của key
+func (l *AuthLimiter) Locked(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, exists := l.entries[key]
+	if !exists {
+		return 0, false
+	}
+
+	remaining := time.Until(entry.lockedUntil)
+	if remaining <= 0 {
+		return 0, false
+	}
+	return remaining, true
+}
+
+// Failure ghi nhận một lần xác thực sai, khóa key khi vượt ngưỡng
+func (l *AuthLimiter) Failure(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.cleanup(now)
+
+	entry, exists := l.entries[key]
+	if !exists {
+		entry = &lockoutEntry{}
+		l.entries[key] = entry
+	}
+
+	// Quên các lần sai cũ nếu đã lâu không có thất bại mới
+	if now.Sub(entry.lastFailure) > l.maxLockout {
+		entry.failures = 0
+		entry.lockouts = 0
+	}
+
+	entry.failures++
+	entry.lastFailure = now
+	if entry.failures < l.maxFailures {
+		return
+	}
+
+	lockout := l.baseLockout << entry.lockouts
+	if lockout > l.maxLockout || lockout <= 0 {
+		lockout = l.maxLockout
+	}
+
+	entry.lockedUntil = now.Add(lockout)
+	entry.lockouts++
+	entry.failures = 0
+	logger.Warn("Locked out %s for %v after repeated authentication failures", key, lockout)
+}
+
+// Success xóa bộ đếm của key sau khi xác thực thành công
+func (l *AuthLimiter) Success(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// cleanup xóa các entry đã hết khóa và không còn thất bại gần đây (gọi khi đang giữ mu)
+func (l *AuthLimiter) cleanup(now time.Time) {
+	if len(l.entries) < 10000 {
+		return
+	}
+	for key, entry := range l.entries {
+		if now.After(entry.lockedUntil) && now.Sub(entry.lastFailure) > l.maxLockout {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// lockoutKeys trả về các key theo dõi cho IP nguồn và username. Bộ đếm của username gắn với
+// IP nguồn để kẻ dò mật khẩu không khóa được user hợp lệ ở mọi IP khác; đổi lại, dò mật khẩu
+// của một user từ nhiều IP chỉ bị chặn bởi bộ đếm theo IP.
+func lockoutKeys(clientIP, username string) []string {
+	var keys []string
+	if clientIP != "" {
+		keys = append(keys, "ip:"+clientIP)
+	}
+	if username != "" {
+		keys = append(keys, userLockoutKey(clientIP, username))
+	}
+	return keys
+}
+
+// userLockoutKey là key theo dõi username tại một IP nguồn
+func userLockoutKey(clientIP, username string) string {
+	if clientIP == "" {
+		return "user:" + username
+	}
+	return "user:" + username + "@" + clientIP
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuthLimiterExponentialLockout(t *testing.T) {
+	l := NewAuthLimiter(3, time.Minute, 3*time.Minute)
+	const key = "ip:1.2.3.4"
+
+	lockAndCheck := func(want time.Duration) {
+		t.Helper()
+		for i := 0; i < 2; i++ {
+			l.Failure(key)
+			if _, locked := l.Locked(key); locked {
+				t.Fatalf("locked after %d failures, want 3", i+1)
+			}
+		}
+		l.Failure(key)
+		remaining, locked := l.Locked(key)
+		if !locked || remaining > want || remaining < want-time.Second {
+			t.Fatalf("got locked=%v for %v, want %v", locked, remaining, want)
+		}
+		// Hết thời gian khóa
+		l.entries[key].lockedUntil = time.Now().Add(-time.Second)
+	}
+
+	lockAndCheck(time.Minute)
+	lockAndCheck(2 * time.Minute)
+	// Lần thứ ba là 4 phút nhưng bị giới hạn ở maxLockout
+	lockAndCheck(3 * time.Minute)
+
+	// Thành công xóa bộ đếm, lần khóa sau bắt đầu lại từ baseLockout
+	l.Success(key)
+	lockAndCheck(time.Minute)
+}
+
+func TestAuthLimiterForgetsOldFailures(t *testing.T) {
+	l := NewAuthLimiter(2, time.Minute, time.Hour)
+	const key = "ip:1.2.3.4"
+
+	l.Failure(key)
+	l.entries[key].lastFailure = time.Now().Add(-2 * time.Hour)
+	l.Failure(key)
+	if _, locked := l.Locked(key); locked {
+		t.Fatal("failure older than maxLockout was counted")
+	}
+}
+
+func TestAuthLimiterCheckRetryAfter(t *testing.T) {
+	l := NewAuthLimiter(1, 90*time.Second, time.Hour)
+	keys := lockoutKeys("1.2.3.4", "alice")
+	if err := l.Check(keys...); err != nil {
+		t.Fatal(err)
+	}
+
+	l.Failure(keys[1])
+	err := l.Check(keys...)
+	var lockedErr *authLockedError
+	if !errors.As(err, &lockedErr) {
+		t.Fatalf("got %v, want lockout error", err)
+	}
+	if lockedErr.key != keys[1] {
+		t.Fatalf("got locked key %q, want %q", lockedErr.key, keys[1])
+	}
+	if got := lockedErr.retryAfter(); got < 89 || got > 90 {
+		t.Fatalf("got Retry-After %d, want 90", got)
+	}
+
+	if got := (&authLockedError{remaining: 2 * time.Second}).retryAfter(); got != 2 {
+		t.Fatalf("got Retry-After %d for exactly 2s, want 2", got)
+	}
+	if got := (&authLockedError{remaining: 1500 * time.Millisecond}).retryAfter(); got != 2 {
+		t.Fatalf("got Retry-After %d for 1.5s, want 2", got)
+	}
+}
+
+func TestLockoutKeysScopeUserToClientIP(t *testing.T) {
+	l := NewAuthLimiter(1, time.Minute, time.Hour)
+
+	// Kẻ dò mật khẩu của alice từ một IP không khóa alice ở IP khác
+	for _, key := range lockoutKeys("6.6.6.6", "alice") {
+		l.Failure(key)
+	}
+	if err := l.Check(lockoutKeys("6.6.6.6", "alice")...); err == nil {
+		t.Fatal("attacker IP not locked")
+	}
+	if err := l.Check(lockoutKeys("1.2.3.4", "alice")...); err != nil {
+		t.Fatalf("alice locked out from another IP: %v", err)
+	}
+
+	if got := lockoutKeys("", "alice"); len(got) != 1 || got[0] != "user:alice" {
+		t.Fatalf("got keys %v without client IP", got)
+	}
+}
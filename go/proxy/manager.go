@@ -1,96 +1,158 @@
 package proxy
 
 import (
-	"bufio"
 	"fmt"
-	"math/rand"
-	"net/http"
-	"net/url"
-	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// ProxyManager quản lý danh sách proxy
+// ProxyManager quản lý danh sách proxy.
+//
+// mu bảo vệ thành phần của pool (proxies và các index) cùng cấu hình; chọn proxy và ghi nhận
+// kết quả request chỉ giữ mu để đọc, trạng thái từng proxy có khóa riêng (xem Proxy).
+// Thứ tự khóa: mu, rồi mu của proxy, rồi các khóa riêng (sessionsMu, eventsMu, groupsMu).
 type ProxyManager struct {
-	proxies       []*Proxy
+	proxies []*Proxy
+	// byID và byURL là index của proxies theo Proxy.ID() và URL
+	byID          map[string]*Proxy
+	byURL         map[string]*Proxy
 	maxRetries    int
 	failThreshold int
 	mu            sync.RWMutex
-	used          map[string]time.Time
-	testURL       string
-	checkInterval time.Duration
-	rand          *rand.Rand
+	sessions      map[string]*stickySession
+	sessionsMu    sync.Mutex
+	sessionTTL    time.Duration
+	sessionByIP   bool
+	lastPrune     time.Time
+	sources       []*sourceEntry
+	// expiredSources là các nguồn đã lỗi quá stale window, proxy của chúng không được chọn
+	expiredSources map[string]bool
+	healthCheck    HealthCheckOptions
+	strategy       Strategy
+	quarantine     QuarantineOptions
+	stateEvents    []StateEvent
+	stateListeners []func(StateEvent)
+	eventsMu       sync.Mutex
+	// groups có khóa riêng vì được đọc trong selector khi đang giữ mu;
+	// groupOrder giữ thứ tự trong file cấu hình để chọn chính sách cho proxy thuộc nhiều group
+	groups     map[string]*ProxyGroup
+	groupOrder []*ProxyGroup
+	groupsMu   sync.RWMutex
 }
 
 func NewProxyManager() *ProxyManager {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	return &ProxyManager{
-		proxies:       make([]*Proxy, 0),
-		maxRetries:    3,
-		failThreshold: 5,
-		used:          make(map[string]time.Time),
-		testURL:       "http://ip4.me/api",
-		checkInterval: 5 * time.Minute,
-		rand:          r,
+		proxies:        make([]*Proxy, 0),
+		byID:           make(map[string]*Proxy),
+		byURL:          make(map[string]*Proxy),
+		maxRetries:     3,
+		failThreshold:  5,
+		sessions:       make(map[string]*stickySession),
+		sessionTTL:     30 * time.Minute,
+		expiredSources: make(map[string]bool),
+		healthCheck: HealthCheckOptions{
+			Targets:  []string{"http://ip4.me/api"},
+			Interval: time.Minute,
+			Timeout:  10 * time.Second,
+			Workers:  10,
+		},
+		strategy: randomStrategy{},
+		quarantine: QuarantineOptions{
+			BaseBackoff:       30 * time.Second,
+			MaxBackoff:        30 * time.Minute,
+			RecoverySuccesses: 3,
+		},
 	}
 }
 
-func (pm *ProxyManager) AddProxy(proxy *Proxy) {
+// ReconcileProxies đồng bộ các proxy của source với danh sách đầy đủ mới nhất: thêm proxy mới,
+// cập nhật thông tin đăng nhập đã xoay của cùng key và gỡ các proxy không còn trong danh sách
+func (pm *ProxyManager) ReconcileProxies(source string, proxies []*Proxy) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	// Kiểm tra xem proxy đã tồn tại chưa
+	existing := make(map[string]*Proxy)
 	for _, p := range pm.proxies {
-		if p.URL == proxy.URL {
-			return
+		if p.Source == source {
+			existing[p.ID()] = p
+		}
+	}
+
+	seen := make(map[string]bool)
+	replaced := make(map[*Proxy]*Proxy)
+	added, updated := 0, 0
+	for _, incoming := range proxies {
+		id := incoming.ID()
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		if current, exists := existing[id]; exists {
+			rotated, err := pm.updateProxy(current, incoming, replaced)
+			if err != nil {
+				// Giữ bản đang có, lần đồng bộ sau sẽ thử lại
+				logger.Warn("Source %s: not updating proxy %s: %v", source, current.Describe(), err)
+			}
+			if rotated {
+				updated++
+			}
+			continue
+		}
+		if pm.addProxy(incoming) {
+			added++
 		}
 	}
+	pm.replaceEntries(replaced)
 
-	pm.proxies = append(pm.proxies, proxy)
+	removed := pm.removeWhere(func(p *Proxy) bool {
+		return p.Source == source && !seen[p.ID()]
+	})
+
+	if added > 0 || updated > 0 || removed > 0 {
+		logger.Info("Reconciled source %s: %d added, %d updated, %d removed", source, added, updated, removed)
+	}
 }
 
+// GetRandomProxy trả về một proxy HTTP ngẫu nhiên trong pool
 func (pm *ProxyManager) GetRandomProxy() *Proxy {
-	// Lấy proxy mới từ API
-	proxy, err := GetProxyForRequest(ProxyTypeHTTP)
-	if err != nil {
-		return nil
-	}
-	return proxy
+	return pm.GetRandomProxyWithFilter(func(p *Proxy) bool {
+		return p.Type == ProxyTypeHTTP || p.Type == ProxyTypeUnknown
+	})
 }
 
 func (pm *ProxyManager) MarkProxySuccess(proxy *Proxy) {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
 
-	for _, p := range pm.proxies {
-		if p.URL == proxy.URL {
-			p.FailCount = 0
-			p.IsWorking = true
-			return
-		}
+	if p := pm.proxyByID(proxy.ID()); p != nil {
+		atomic.AddInt64(&p.Requests, 1)
+		p.mu.Lock()
+		observeResult(p, true)
+		pm.recordSuccess(p, false)
+		p.releaseTrial()
+		p.mu.Unlock()
 	}
 }
 
+// MarkProxyFailure ghi nhận một request lỗi qua proxy, giống MarkProxyFailed
 func (pm *ProxyManager) MarkProxyFailure(proxy *Proxy) {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-
-	for _, p := range pm.proxies {
-		if p.URL == proxy.URL {
-			p.FailCount++
-			p.IsWorking = false
-			return
-		}
-	}
+	pm.MarkProxyFailed(proxy)
 }
 
 // SetTestURL changes the URL used for testing proxies
 func (pm *ProxyManager) SetTestURL(url string) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
-	pm.testURL = url
+	pm.healthCheck.Targets = []string{url}
+}
+
+// SetStrategy đặt strategy mặc định dùng để chọn upstream
+func (pm *ProxyManager) SetStrategy(strategy Strategy) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.strategy = strategy
 }
 
 // SetMaxRetries sets the maximum number of retries with different proxies
@@ -111,314 +173,159 @@ func (pm *ProxyManager) SetMaxFails(fails int) {
 func (pm *ProxyManager) SetCheckInterval(duration time.Duration) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
-	pm.checkInterval = duration
+	pm.healthCheck.Interval = duration
 }
 
+// LoadProxies tải proxy từ file danh sách (text, CSV, JSON hoặc YAML theo phần mở rộng),
+// mục sai định dạng được ghi cảnh báo kèm số dòng và bỏ qua
 func (pm *ProxyManager) LoadProxies(filename string) error {
-	file, err := os.Open(filename)
+	list, err := ReadProxyListFile(filename, ProxyTypeHTTP)
 	if err != nil {
-		return fmt.Errorf("failed to open proxy list file: %v", err)
+		return err
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		proxy, err := parseProxy(line)
-		if err != nil {
-			continue
-		}
-		proxy.IsWorking = true // Assume working by default
-		pm.proxies = append(pm.proxies, proxy)
+	for _, entryErr := range list.Errors {
+		logger.Warn("Skipping invalid proxy in %s at %v", filename, entryErr)
+	}
+	for _, proxy := range list.Proxies {
+		pm.AddProxy(proxy)
 	}
 
-	if len(pm.proxies) == 0 {
+	if pm.GetProxyCount() == 0 {
 		return fmt.Errorf("no valid proxies found in file")
 	}
 
-	// Start background health checking
-	go pm.startHealthChecks()
-
 	return nil
 }
 
-// startHealthChecks runs periodic health checks on all proxies
-func (pm *ProxyManager) startHealthChecks() {
-	ticker := time.NewTicker(pm.checkInterval)
-	defer ticker.Stop()
-
-	for {
-		<-ticker.C
-		pm.checkAllProxies()
-	}
-}
-
-// checkAllProxies tests all proxies in the pool
-func (pm *ProxyManager) checkAllProxies() {
-	pm.mu.Lock()
-	proxies := make([]*Proxy, len(pm.proxies))
-	copy(proxies, pm.proxies)
-	pm.mu.Unlock()
-
-	for _, proxy := range proxies {
-		isWorking := pm.testProxy(proxy)
-
-		pm.mu.Lock()
-		proxy.LastChecked = time.Now()
-		proxy.IsWorking = isWorking
-		if !isWorking {
-			proxy.FailCount++
-		} else {
-			proxy.FailCount = 0 // Reset fail count on success
-		}
-		pm.mu.Unlock()
-	}
-
-	// Remove proxies with too many failures
-	pm.cleanupFailedProxies()
+// MarkProxyFailed marks a proxy as failed and increments its failure count
+func (pm *ProxyManager) MarkProxyFailed(failedProxy *Proxy) {
+	pm.mu.RLock()
+	if proxy := pm.proxyByID(failedProxy.ID()); proxy != nil {
+		atomic.AddInt64(&proxy.Requests, 1)
+		atomic.AddInt64(&proxy.Failures, 1)
+		proxy.mu.Lock()
+		observeResult(proxy, false)
+		pm.recordFailure(proxy, false, "request failed")
+		proxy.releaseTrial()
+		logger.Info("Marked proxy as failed: %s (fail count: %d, state: %s)", proxy.Describe(), proxy.FailCount, proxy.state())
+		proxy.mu.Unlock()
+	}
+	pm.mu.RUnlock()
+
+	// Báo các nguồn làm mới pool để bù proxy vừa lỗi (gửi không chặn)
+	pm.RequestRefresh()
 }
 
-// testProxy checks if a proxy is working by making a test request
-func (pm *ProxyManager) testProxy(proxy *Proxy) bool {
-	var proxyURL *url.URL
-	var err error
-
-	// Parse proxy URL based on format
-	if strings.Contains(proxy.URL, "http://") {
-		// URL already has scheme
-		proxyURL, err = url.Parse(proxy.URL)
-	} else {
-		// Add scheme
-		proxyURL, err = url.Parse("http://" + proxy.URL)
-	}
-
-	if err != nil {
+// usable cho biết proxy có thể được chọn để phục vụ request tại thời điểm now (gọi khi đang giữ mu).
+// Trạng thái sức khỏe được đọc atomic nên không cần khóa proxy.
+func (pm *ProxyManager) usable(proxy *Proxy, now time.Time) bool {
+	if !proxy.admitsTraffic(now.UnixNano()) || !proxy.servable(now.UnixNano()) {
 		return false
 	}
-
-	// Set proxy authentication if needed
-	if proxy.Username != "" && proxy.Password != "" {
-		proxyURL.User = url.UserPassword(proxy.Username, proxy.Password)
-	}
-
-	// Create HTTP client with proxy
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyURL(proxyURL),
-		},
-		Timeout: 10 * time.Second,
-	}
-
-	// Try to fetch the test URL
-	resp, err := client.Get(pm.testURL)
-	if err != nil {
-		logger.Info("Proxy test failed for %s: %v", proxy.URL, err)
-		return false
-	}
-	defer resp.Body.Close()
-
-	// Check if status code is successful
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		logger.Info("Proxy test failed for %s: status code %d", proxy.URL, resp.StatusCode)
-		return false
-	}
-
-	logger.Info("Proxy test successful for %s", proxy.URL)
-	return true
+	return len(pm.expiredSources) == 0 || !pm.expiredSources[proxy.Source]
 }
 
-// cleanupFailedProxies removes proxies with too many failures
-func (pm *ProxyManager) cleanupFailedProxies() {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-
-	var workingProxies []*Proxy
-	for _, proxy := range pm.proxies {
-		if proxy.FailCount < pm.failThreshold {
-			workingProxies = append(workingProxies, proxy)
-		} else {
-			logger.Info("Removing failed proxy: %s (failed %d times)", proxy.URL, proxy.FailCount)
-		}
-	}
-
-	pm.proxies = workingProxies
+// candidatePool tái sử dụng danh sách ứng viên khi chọn proxy, tránh cấp phát lại
+// mảng lớn cho mỗi request khi pool có hàng chục nghìn proxy
+var candidatePool = sync.Pool{
+	New: func() interface{} { return new([]*Proxy) },
 }
 
-// MarkProxyFailed marks a proxy as failed and increments its failure count
-func (pm *ProxyManager) MarkProxyFailed(failedProxy *Proxy) {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
+// GetNextWorkingProxy returns the next working proxy
+func (pm *ProxyManager) GetNextWorkingProxy(excludeURL string) *Proxy {
+	return pm.nextWorkingProxy(excludeURL, func(*Proxy) bool { return true })
+}
 
-	for _, proxy := range pm.proxies {
-		if proxy.URL == failedProxy.URL {
-			proxy.IsWorking = false
-			proxy.FailCount++
-			logger.Info("Marked proxy as failed: %s (fail count: %d)", proxy.URL, proxy.FailCount)
-			break
-		}
-	}
+// nextWorkingProxy returns the least recently used working proxy accepted by selector
+func (pm *ProxyManager) nextWorkingProxy(excludeURL string, selector ProxySelector) *Proxy {
+	return pm.selectProxy(excludeURL, selector, lruStrategy{})
 }
 
-// GetNextWorkingProxy returns the next working proxy
-func (pm *ProxyManager) GetNextWorkingProxy(excludeURL string) *Proxy {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
+// selectProxy lọc các proxy dùng được có priority cao nhất rồi để strategy chọn một,
+// strategy nil thì dùng strategy mặc định của ProxyManager. Chỉ giữ mu để đọc nên
+// các request chọn proxy song song không chặn nhau.
+func (pm *ProxyManager) selectProxy(excludeURL string, selector ProxySelector, strategy Strategy) *Proxy {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
 
-	if len(pm.proxies) == 0 {
-		return nil
+	// Xếp hạng theo priority, cùng priority thì proxy degraded chỉ được chọn khi không còn proxy khác
+	rank := func(p *Proxy) int {
+		if p.loadStatus() == statusDegraded {
+			return p.Priority * 2
+		}
+		return p.Priority*2 + 1
 	}
 
-	// Find proxy that is working, hasn't been used or used longest time ago
-	var selectedProxy *Proxy
-	var oldestUsedTime time.Time
-	first := true
+	now := time.Now()
+	buf := candidatePool.Get().(*[]*Proxy)
+	candidates := (*buf)[:0]
+	defer func() {
+		// Xóa con trỏ để proxy đã gỡ khỏi pool không bị giữ lại trong buffer
+		clear(candidates)
+		*buf = candidates[:0]
+		candidatePool.Put(buf)
+	}()
 
+	var best int
 	for _, proxy := range pm.proxies {
-		// Skip the excluded proxy and non-working proxies
-		if proxy.URL == excludeURL || !proxy.IsWorking {
+		// Bỏ qua proxy bị loại trừ, proxy không dùng được và proxy không qua bộ lọc
+		if proxy.URL == excludeURL || !pm.usable(proxy, now) || !selector(proxy) {
 			continue
 		}
-
-		lastUsed, exists := pm.used[proxy.URL]
-		if !exists {
-			// If proxy hasn't been used, select it immediately
-			selectedProxy = proxy
-			break
-		}
-
-		if first || lastUsed.Before(oldestUsedTime) {
-			oldestUsedTime = lastUsed
-			selectedProxy = proxy
-			first = false
-		}
-	}
-
-	// Update last used time
-	if selectedProxy != nil {
-		pm.used[selectedProxy.URL] = time.Now()
-	}
-
-	return selectedProxy
-}
-
-func parseProxy(line string) (*Proxy, error) {
-	line = strings.TrimSpace(line)
-	if line == "" {
-		return nil, fmt.Errorf("empty line")
-	}
-
-	// Format: user:pass@ip:port
-	if strings.Contains(line, "@") {
-		parts := strings.Split(line, "@")
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid proxy format")
+		r := rank(proxy)
+		if len(candidates) > 0 && r < best {
+			continue
 		}
-
-		auth := strings.Split(parts[0], ":")
-		if len(auth) != 2 {
-			return nil, fmt.Errorf("invalid auth format")
+		if len(candidates) > 0 && r > best {
+			candidates = candidates[:0]
 		}
-
-		return &Proxy{
-			URL:      fmt.Sprintf("http://%s", parts[1]),
-			Username: auth[0],
-			Password: auth[1],
-			LastUsed: time.Time{},
-		}, nil
-	}
-
-	// Format: ip:port:user:pass
-	parts := strings.Split(line, ":")
-	if len(parts) == 4 {
-		return &Proxy{
-			URL:      fmt.Sprintf("http://%s:%s", parts[0], parts[1]),
-			Username: parts[2],
-			Password: parts[3],
-			LastUsed: time.Time{},
-		}, nil
-	}
-
-	// Format: ip:port
-	if len(parts) == 2 {
-		return &Proxy{
-			URL:      fmt.Sprintf("http://%s:%s", parts[0], parts[1]),
-			Username: "",
-			Password: "",
-			LastUsed: time.Time{},
-		}, nil
-	}
-
-	// Format: ip
-	if len(parts) == 1 {
-		return &Proxy{
-			URL:      fmt.Sprintf("http://%s", parts[0]),
-			Username: "",
-			Password: "",
-			LastUsed: time.Time{},
-		}, nil
-	}
-
-	return nil, fmt.Errorf("invalid proxy format")
-}
-
-func splitProxyLine(line string) []string {
-	var parts []string
-	var current string
-	var inQuotes bool
-
-	for _, char := range line {
-		switch char {
-		case ':':
-			if !inQuotes {
-				parts = append(parts, current)
-				current = ""
-			} else {
-				current += string(char)
+		best = r
+		candidates = append(candidates, proxy)
+	}
+
+	if strategy == nil {
+		strategy = pm.strategy
+	}
+	for len(candidates) > 0 {
+		selectedProxy := strategy.Select(candidates)
+		// Proxy half-open chỉ nhận một kết nối thử, request khác giữ chỗ trước thì chọn lại
+		if !selectedProxy.reserveTrial(now.UnixNano()) {
+			for i, p := range candidates {
+				if p == selectedProxy {
+					last := len(candidates) - 1
+					copy(candidates[i:], candidates[i+1:])
+					candidates[last] = nil
+					candidates = candidates[:last]
+					break
+				}
 			}
-		case '"':
-			inQuotes = !inQuotes
-		default:
-			current += string(char)
+			continue
 		}
+		selectedProxy.touch(now)
+		return selectedProxy
 	}
-
-	if current != "" {
-		parts = append(parts, current)
-	}
-
-	return parts
+	return nil
 }
 
-// GetRandomProxyWithFilter trả về một proxy ngẫu nhiên phù hợp với bộ lọc
+// GetRandomProxyWithFilter trả về một proxy ngẫu nhiên trong pool phù hợp với bộ lọc,
+// không gọi API trên đường xử lý request
 func (pm *ProxyManager) GetRandomProxyWithFilter(selector ProxySelector) *Proxy {
-	// Lấy proxy mới từ API
-	proxy, err := GetProxyForRequest(ProxyTypeHTTP)
-	if err != nil {
-		return nil
-	}
-
-	// Kiểm tra xem proxy có phù hợp với bộ lọc không
-	if selector(proxy) {
-		return proxy
-	}
-
-	return nil
+	return pm.SelectProxy("", selector, randomStrategy{})
 }
 
-// GetNextWorkingProxyWithFilter trả về proxy tiếp theo phù hợp với bộ lọc
+// GetNextWorkingProxyWithFilter trả về proxy lâu chưa dùng nhất phù hợp với bộ lọc
 func (pm *ProxyManager) GetNextWorkingProxyWithFilter(excludeURL string, selector ProxySelector) *Proxy {
-	// Lấy proxy mới từ API
-	proxy, err := GetProxyForRequest(ProxyTypeHTTP)
-	if err != nil {
-		return nil
-	}
+	return pm.SelectProxy(excludeURL, selector, lruStrategy{})
+}
 
-	// Kiểm tra xem proxy có phù hợp với bộ lọc không
-	if proxy.URL != excludeURL && selector(proxy) {
-		return proxy
+// SelectProxy chọn proxy phù hợp với bộ lọc bằng strategy (nil là strategy mặc định),
+// báo các nguồn làm mới pool nếu không còn proxy nào phù hợp
+func (pm *ProxyManager) SelectProxy(excludeURL string, selector ProxySelector, strategy Strategy) *Proxy {
+	proxy := pm.selectProxy(excludeURL, selector, strategy)
+	if proxy == nil {
+		pm.RequestRefresh()
 	}
-
-	return nil
+	return proxy
 }
 
 func (pm *ProxyManager) GetProxyCount() int {
@@ -429,3 +336,26 @@ func (pm *ProxyManager) GetProxyCount() int {
 
 // ProxySelector định nghĩa hàm lọc proxy theo tiêu chí
 type ProxySelector func(*Proxy) bool
+
+// SelectCarrier lọc proxy theo nhà mạng của key
+func SelectCarrier(carrier string) ProxySelector {
+	carrier = normalizeRouteValue(carrier)
+	return func(p *Proxy) bool {
+		return normalizeRouteValue(p.Carrier) == carrier
+	}
+}
+
+// SelectLocation lọc proxy theo vị trí của key
+func SelectLocation(location string) ProxySelector {
+	location = normalizeRouteValue(location)
+	return func(p *Proxy) bool {
+		return normalizeRouteValue(p.Location) == location
+	}
+}
+
+// SelectKey lọc proxy theo key ID của key manager
+func SelectKey(keyID string) ProxySelector {
+	return func(p *Proxy) bool {
+		return p.KeyID == keyID
+	}
+}
@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hệ số làm mượt EWMA của các chỉ số thụ động
+const (
+	latencyAlpha    = 0.3
+	ttfbAlpha       = 0.3
+	successAlpha    = 0.1
+	throughputAlpha = 0.3
+)
+
+// minThroughputBytes là lượng dữ liệu tối thiểu của một kết nối để tính throughput,
+// tránh để các phản hồi nhỏ kéo lệch số đo
+const minThroughputBytes = 32 * 1024
+
+// Mốc tham chiếu khi quy đổi độ trễ ra điểm: độ trễ bằng mốc cho điểm 0.5
+const (
+	latencyReference = 200 * time.Millisecond
+	ttfbReference    = time.Second
+)
+
+// ewma cập nhật giá trị trung bình với mẫu mới, giá trị 0 được coi là chưa có số đo
+func ewma(current, sample, alpha float64) float64 {
+	if current == 0 {
+		return sample
+	}
+	return alpha*sample + (1-alpha)*current
+}
+
+// proxyMetrics là các chỉ số thụ động của proxy. Ghi được tuần tự hóa bằng mu của proxy,
+// đọc bằng sync/atomic nên strategy đọc được khi chọn proxy mà không cần khóa.
+type proxyMetrics struct {
+	// latency là độ trễ kết nối trung bình (nano giây)
+	latency int64
+	// ttfb là thời gian từ khi gửi request tới byte phản hồi đầu tiên (nano giây)
+	ttfb int64
+	// successRate là tỉ lệ request thành công trên samples mẫu (bit của float64)
+	successRate uint64
+	samples     int64
+	// throughput là tốc độ tải về, byte/giây (bit của float64)
+	throughput uint64
+}
+
+func loadFloat(addr *uint64) float64 {
+	return math.Float64frombits(atomic.LoadUint64(addr))
+}
+
+func storeFloat(addr *uint64, value float64) {
+	atomic.StoreUint64(addr, math.Float64bits(value))
+}
+
+// Latency trả về độ trễ kết nối trung bình (EWMA)
+func (p *Proxy) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.metrics.latency))
+}
+
+// TTFB trả về thời gian tới byte đầu tiên trung bình (EWMA)
+func (p *Proxy) TTFB() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.metrics.ttfb))
+}
+
+// SuccessRate trả về tỉ lệ request thành công (EWMA)
+func (p *Proxy) SuccessRate() float64 {
+	return loadFloat(&p.metrics.successRate)
+}
+
+// Samples trả về số mẫu đã dùng để tính tỉ lệ thành công
+func (p *Proxy) Samples() int64 {
+	return atomic.LoadInt64(&p.metrics.samples)
+}
+
+// Throughput trả về tốc độ tải về trung bình (byte/giây, EWMA)
+func (p *Proxy) Throughput() float64 {
+	return loadFloat(&p.metrics.throughput)
+}
+
+// ObserveLatency cập nhật độ trễ kết nối trung bình (EWMA) của proxy
+func (pm *ProxyManager) ObserveLatency(proxy *Proxy, latency time.Duration) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	atomic.StoreInt64(&proxy.metrics.latency, int64(ewma(float64(proxy.Latency()), float64(latency), latencyAlpha)))
+}
+
+// ObserveTTFB cập nhật thời gian tới byte đầu tiên trung bình (EWMA) của proxy
+func (pm *ProxyManager) ObserveTTFB(proxy *Proxy, ttfb time.Duration) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	atomic.StoreInt64(&proxy.metrics.ttfb, int64(ewma(float64(proxy.TTFB()), float64(ttfb), ttfbAlpha)))
+}
+
+// ObserveThroughput cập nhật throughput trung bình (byte/giây, EWMA) của proxy
+func (pm *ProxyManager) ObserveThroughput(proxy *Proxy, bytes int64, elapsed time.Duration) {
+	if bytes < minThroughputBytes || elapsed <= 0 {
+		return
+	}
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	storeFloat(&proxy.metrics.throughput, ewma(proxy.Throughput(), float64(bytes)/elapsed.Seconds(), throughputAlpha))
+}
+
+// observeResult cập nhật tỉ lệ thành công (EWMA) của proxy (gọi khi đang giữ mu của proxy)
+func observeResult(proxy *Proxy, ok bool) {
+	sample := 0.0
+	if ok {
+		sample = 1
+	}
+	if proxy.Samples() == 0 {
+		storeFloat(&proxy.metrics.successRate, sample)
+	} else {
+		storeFloat(&proxy.metrics.successRate, successAlpha*sample+(1-successAlpha)*proxy.SuccessRate())
+	}
+	atomic.AddInt64(&proxy.metrics.samples, 1)
+}
+
+// HealthScore là điểm sức khỏe từ 0 tới 1 tính từ tỉ lệ thành công, độ trễ kết nối và TTFB.
+// Chỉ số chưa có số đo được coi là tốt để proxy mới có cơ hội nhận traffic.
+func (p *Proxy) HealthScore() float64 {
+	success := 1.0
+	if p.Samples() > 0 {
+		success = p.SuccessRate()
+	}
+	return 0.6*success + 0.2*latencyScore(p.Latency(), latencyReference) + 0.2*latencyScore(p.TTFB(), ttfbReference)
+}
+
+func latencyScore(value, reference time.Duration) float64 {
+	if value <= 0 {
+		return 1
+	}
+	return float64(reference) / float64(reference+value)
+}
+
+// TrackConnection ghi nhận một kết nối đang mở qua proxy, trả về hàm cần gọi khi kết nối đóng
+func (pm *ProxyManager) TrackConnection(proxy *Proxy) func() {
+	atomic.AddInt64(&proxy.ActiveConns, 1)
+	return func() {
+		atomic.AddInt64(&proxy.ActiveConns, -1)
+	}
+}
+
+// TrackTransfer bọc kết nối tới upstream để đo TTFB (từ lần ghi đầu tới lần đọc đầu)
+// và throughput chiều tải về. Hàm trả về cần được gọi khi kết nối kết thúc.
+func (pm *ProxyManager) TrackTransfer(proxy *Proxy, conn net.Conn) (net.Conn, func()) {
+	tc := &transferConn{Conn: conn, onTTFB: func(ttfb time.Duration) { pm.ObserveTTFB(proxy, ttfb) }}
+	return tc, func() {
+		tc.mu.Lock()
+		bytes, elapsed := tc.bytes, tc.lastRead.Sub(tc.firstRead)
+		tc.mu.Unlock()
+		pm.ObserveThroughput(proxy, bytes, elapsed)
+	}
+}
+
+// transferConn đếm dữ liệu đọc từ upstream và ghi nhận TTFB cho proxy
+type transferConn struct {
+	net.Conn
+	mu         sync.Mutex
+	firstWrite time.Time
+	firstRead  time.Time
+	lastRead   time.Time
+	bytes      int64
+	onTTFB     func(time.Duration)
+}
+
+func (c *transferConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.firstWrite.IsZero() {
+		c.firstWrite = time.Now()
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *transferConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		now := time.Now()
+		var ttfb time.Duration
+		c.mu.Lock()
+		if c.firstRead.IsZero() {
+			c.firstRead = now
+			if !c.firstWrite.IsZero() {
+				ttfb = now.Sub(c.firstWrite)
+			}
+		}
+		c.lastRead = now
+		c.bytes += int64(n)
+		c.mu.Unlock()
+
+		if ttfb > 0 && c.onTTFB != nil {
+			c.onTTFB(ttfb)
+		}
+	}
+	return n, err
+}
+
+// ProxyHealth là các chỉ số thụ động và điểm sức khỏe của một proxy
+type ProxyHealth struct {
+	URL          string    `json:"url"`
+	KeyID        string    `json:"key_id,omitempty"`
+	Type         ProxyType `json:"type"`
+	Score        float64   `json:"score"`
+	SuccessRate  float64   `json:"success_rate"`
+	Samples      int64     `json:"samples"`
+	LatencyMs    int64     `json:"latency_ms"`
+	TTFBMs       int64     `json:"ttfb_ms"`
+	ThroughputBs int64     `json:"throughput_bps"`
+	IsWorking    bool      `json:"is_working"`
+}
+
+// HealthScores trả về chỉ số sức khỏe của các proxy, điểm cao trước
+func (pm *ProxyManager) HealthScores() []ProxyHealth {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	result := make([]ProxyHealth, 0, len(pm.proxies))
+	for _, p := range pm.proxies {
+		h := ProxyHealth{
+			URL:          p.Redacted(),
+			Type:         p.Type,
+			Score:        p.HealthScore(),
+			SuccessRate:  p.SuccessRate(),
+			Samples:      p.Samples(),
+			LatencyMs:    p.Latency().Milliseconds(),
+			TTFBMs:       p.TTFB().Milliseconds(),
+			ThroughputBs: int64(p.Throughput()),
+			IsWorking:    p.loadStatus() != statusDown,
+		}
+		if p.KeyID != "" {
+			h.KeyID = maskKey(p.KeyID)
+		}
+		result = append(result, h)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Score > result[j].Score })
+	return result
+}
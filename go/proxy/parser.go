@@ -2,52 +2,328 @@ package proxy
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
 	"strings"
-	"time"
 )
 
-// ParseProxy parses a proxy string into a Proxy struct
-func ParseProxy(line string) (*Proxy, error) {
+// proxySchemes là các scheme được nhận trong dòng proxy
+var proxySchemes = map[string]bool{
+	"http":    true,
+	"https":   true,
+	"socks4":  true,
+	"socks5":  true,
+	"socks5h": true,
+}
+
+// proxyAddress là kết quả phân tích một dòng proxy, scheme rỗng nếu dòng không ghi scheme
+type proxyAddress struct {
+	scheme   string
+	host     string
+	port     string
+	username string
+	password string
+}
+
+// ParseProxy phân tích một dòng proxy thành Proxy. Các định dạng được nhận:
+//
+//	scheme://[user:pass@]host:port   (http, https, socks4, socks5, socks5h)
+//	user:pass@host:port
+//	host:port:user:pass
+//	host:port
+//
+// host là IPv4, hostname hoặc IPv6 trong ngoặc vuông. Mật khẩu được chứa ':' và '@';
+// trong URL có scheme, user và pass có thể được mã hóa phần trăm. Dòng không ghi scheme
+// dùng defaultType. Proxy https được kết nối qua TLS; SOCKS4 không có mật khẩu nên với socks4
+// chỉ username được gửi lên upstream (làm user ID) và được phép bỏ mật khẩu, ví dụ
+// socks4://userid@host:port.
+func ParseProxy(line string, defaultType ProxyType) (*Proxy, error) {
+	address, err := parseProxyAddress(line)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := address.scheme
+	if scheme == "" {
+		scheme = "http"
+		switch defaultType {
+		case ProxyTypeSOCKS5:
+			scheme = "socks5"
+		case ProxyTypeSOCKS4:
+			scheme = "socks4"
+		}
+	}
+
+	var proxyType ProxyType
+	switch scheme {
+	case "http", "https":
+		proxyType = ProxyTypeHTTP
+	case "socks4":
+		proxyType = ProxyTypeSOCKS4
+	case "socks5", "socks5h":
+		proxyType = ProxyTypeSOCKS5
+	}
+	if address.username != "" && address.password == "" && proxyType != ProxyTypeSOCKS4 {
+		return nil, fmt.Errorf("missing password for proxy user %q", address.username)
+	}
+
+	return &Proxy{
+		URL:      buildProxyURL(scheme, address.host, address.port, address.username, address.password),
+		Username: address.username,
+		Password: address.password,
+		Type:     proxyType,
+	}, nil
+}
+
+// parseProxyAddress tách scheme, host, port và thông tin đăng nhập của một dòng proxy
+func parseProxyAddress(line string) (*proxyAddress, error) {
 	line = strings.TrimSpace(line)
-	if line == "" || strings.HasPrefix(line, "#") {
-		return nil, fmt.Errorf("empty line or comment")
-	}
-
-	// Check if proxy URL contains @ (user:pass@host:port format)
-	if strings.Contains(line, "@") {
-		parts := strings.Split(line, "@")
-		if len(parts) == 2 {
-			auth := strings.Split(parts[0], ":")
-			if len(auth) == 2 {
-				return &Proxy{
-					URL:      parts[1],
-					Username: auth[0],
-					Password: auth[1],
-					LastUsed: time.Time{},
-					Type:     ProxyTypeUnknown,
-				}, nil
-			}
+	if line == "" {
+		return nil, fmt.Errorf("empty proxy line")
+	}
+
+	if scheme, rest, ok := strings.Cut(line, "://"); ok {
+		return parseSchemeProxy(strings.ToLower(scheme), rest)
+	}
+
+	// user:pass@host:port, tách ở '@' cuối cùng vì mật khẩu có thể chứa '@'
+	if at := strings.LastIndex(line, "@"); at >= 0 {
+		address, err := parseUserinfoProxy(line[:at], line[at+1:])
+		if err == nil {
+			return address, nil
+		}
+		// '@' cũng có thể nằm trong mật khẩu của định dạng host:port:user:pass
+		if address, colonErr := parseColonProxy(line); colonErr == nil {
+			return address, nil
+		}
+		return nil, err
+	}
+
+	return parseColonProxy(line)
+}
+
+// parseSchemeProxy phân tích phần sau "scheme://" của URL proxy
+func parseSchemeProxy(scheme, rest string) (*proxyAddress, error) {
+	if !proxySchemes[scheme] {
+		return nil, fmt.Errorf("unsupported proxy scheme %q (expected http, https, socks4, socks5 or socks5h)", scheme)
+	}
+
+	// URL proxy không có path, query hay fragment; chỉ chấp nhận dấu '/' ở cuối
+	rest = strings.TrimSuffix(rest, "/")
+	userinfo, hostport, hasUserinfo := "", rest, false
+	if at := strings.LastIndex(rest, "@"); at >= 0 {
+		userinfo, hostport, hasUserinfo = rest[:at], rest[at+1:], true
+	}
+	if i := strings.IndexAny(hostport, "/?#"); i >= 0 {
+		return nil, fmt.Errorf("unexpected %q after host:port in proxy URL", hostport[i:])
+	}
+
+	host, port, err := splitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	address := &proxyAddress{scheme: scheme, host: host, port: port}
+	if hasUserinfo {
+		username, password, _ := strings.Cut(userinfo, ":")
+		if username, err = url.PathUnescape(username); err != nil {
+			return nil, fmt.Errorf("invalid percent-encoding in proxy username")
 		}
-	} else if strings.Count(line, ":") == 3 {
-		// ip:port:user:pass format
-		parts := strings.Split(line, ":")
-		if len(parts) == 4 {
-			return &Proxy{
-				URL:      fmt.Sprintf("%s:%s", parts[0], parts[1]),
-				Username: parts[2],
-				Password: parts[3],
-				LastUsed: time.Time{},
-				Type:     ProxyTypeUnknown,
-			}, nil
+		if password, err = url.PathUnescape(password); err != nil {
+			return nil, fmt.Errorf("invalid percent-encoding in proxy password")
 		}
+		if err := address.setCredentials(username, password); err != nil {
+			return nil, err
+		}
+	}
+	return address, nil
+}
+
+// parseUserinfoProxy phân tích định dạng user:pass@host:port đã tách ở '@'
+func parseUserinfoProxy(userinfo, hostport string) (*proxyAddress, error) {
+	host, port, err := splitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	address := &proxyAddress{host: host, port: port}
+	username, password, _ := strings.Cut(userinfo, ":")
+	if err := address.setCredentials(username, password); err != nil {
+		return nil, err
+	}
+	return address, nil
+}
+
+// parseColonProxy phân tích định dạng host:port hoặc host:port:user:pass,
+// mật khẩu là toàn bộ phần sau user nên được chứa ':'
+func parseColonProxy(line string) (*proxyAddress, error) {
+	var host, remainder string
+	if strings.HasPrefix(line, "[") {
+		end := strings.Index(line, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("missing ']' in IPv6 address")
+		}
+		host, remainder = line[1:end], line[end+1:]
+		if !strings.HasPrefix(remainder, ":") {
+			return nil, fmt.Errorf("missing port after IPv6 address [%s]", host)
+		}
+		remainder = remainder[1:]
 	} else {
-		// ip:port or domain:port format
-		return &Proxy{
-			URL:      line,
-			LastUsed: time.Time{},
-			Type:     ProxyTypeUnknown,
-		}, nil
+		var ok bool
+		host, remainder, ok = strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("missing port for host %q", host)
+		}
 	}
 
-	return nil, fmt.Errorf("invalid proxy format")
+	port, credentials, hasCredentials := strings.Cut(remainder, ":")
+	if err := validateHostPort(host, port); err != nil {
+		if !strings.HasPrefix(line, "[") && isBareIPv6(line) {
+			return nil, errBareIPv6
+		}
+		return nil, err
+	}
+
+	address := &proxyAddress{host: host, port: port}
+	if hasCredentials {
+		username, password, _ := strings.Cut(credentials, ":")
+		if err := address.setCredentials(username, password); err != nil {
+			return nil, err
+		}
+	}
+	return address, nil
+}
+
+var errBareIPv6 = fmt.Errorf("IPv6 address must be enclosed in brackets, e.g. [2001:db8::1]:8080")
+
+// isBareIPv6 cho biết dòng bắt đầu bằng địa chỉ IPv6 không có ngoặc vuông, ví dụ 2001:db8::1:8080
+func isBareIPv6(line string) bool {
+	parts := strings.Split(line, ":")
+	for n := len(parts); n >= 3; n-- {
+		if ip := net.ParseIP(strings.Join(parts[:n], ":")); ip != nil && ip.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// splitHostPort tách host:port (IPv6 trong ngoặc vuông) rồi kiểm tra host và port
+func splitHostPort(hostport string) (string, string, error) {
+	if hostport == "" {
+		return "", "", fmt.Errorf("missing host")
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		switch {
+		case strings.HasPrefix(hostport, "[") && !strings.Contains(hostport, "]"):
+			return "", "", fmt.Errorf("missing ']' in IPv6 address")
+		case strings.HasPrefix(hostport, "[") && strings.HasSuffix(hostport, "]"):
+			return "", "", fmt.Errorf("missing port after IPv6 address %s", hostport)
+		case !strings.HasPrefix(hostport, "[") && isBareIPv6(hostport):
+			return "", "", errBareIPv6
+		case !strings.Contains(hostport, ":"):
+			return "", "", fmt.Errorf("missing port for host %q", hostport)
+		default:
+			return "", "", fmt.Errorf("invalid host:port %q", hostport)
+		}
+	}
+	if err := validateHostPort(host, port); err != nil {
+		return "", "", err
+	}
+	return host, port, nil
+}
+
+// validateHostPort kiểm tra host là IP hoặc hostname hợp lệ và port trong khoảng 1-65535
+func validateHostPort(host, port string) error {
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if !isValidHost(host) {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	if port == "" {
+		return fmt.Errorf("missing port for host %q", host)
+	}
+	if !isValidPort(port) {
+		return fmt.Errorf("invalid port %q for host %q (expected 1-65535)", port, host)
+	}
+	return nil
+}
+
+// setCredentials gán thông tin đăng nhập, lỗi không bao giờ chứa mật khẩu. Mật khẩu được để
+// trống vì loại proxy chưa biết ở đây, ParseProxy chỉ nhận username không mật khẩu với socks4.
+func (a *proxyAddress) setCredentials(username, password string) error {
+	if username == "" {
+		return fmt.Errorf("empty username in proxy credentials")
+	}
+	a.username, a.password = username, password
+	return nil
+}
+
+// isValidHost kiểm tra xem chuỗi có phải là IP (v4/v6) hoặc hostname hợp lệ không
+func isValidHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	return isValidHostname(host)
+}
+
+// isValidHostname kiểm tra hostname theo RFC 1123, nhãn cuối không được toàn số
+// để không nhận nhầm IPv4 sai (ví dụ 999.1.1.1) là hostname
+func isValidHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+
+	labels := strings.Split(host, ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	last := labels[len(labels)-1]
+	return strings.Trim(last, "0123456789") != ""
+}
+
+// isValidPort kiểm tra xem chuỗi có phải là port hợp lệ (chỉ gồm chữ số, 1-65535) không
+func isValidPort(port string) bool {
+	if port == "" || strings.Trim(port, "0123456789") != "" {
+		return false
+	}
+	num, err := strconv.Atoi(port)
+	return err == nil && num > 0 && num < 65536
+}
+
+// buildProxyURL tạo URL proxy đầy đủ, thông tin đăng nhập được mã hóa phần trăm
+func buildProxyURL(scheme, host, port, username, password string) string {
+	proxyURL := &url.URL{
+		Scheme: scheme,
+		Host:   net.JoinHostPort(host, port),
+	}
+	proxyURL.User = userinfo(username, password)
+	return proxyURL.String()
+}
+
+// userinfo trả về phần thông tin đăng nhập của URL proxy, chỉ có username khi không có mật khẩu
+// (user ID của socks4)
+func userinfo(username, password string) *url.Userinfo {
+	switch {
+	case username == "":
+		return nil
+	case password == "":
+		return url.User(username)
+	default:
+		return url.UserPassword(username, password)
+	}
 }
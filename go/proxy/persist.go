@@ -0,0 +1,424 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// stateVersion là phiên bản định dạng file trạng thái pool; từ phiên bản 2 key ID nằm trong
+// phần được mã hóa
+const stateVersion = 2
+
+// StateStore lưu trạng thái pool (proxy, sức khỏe, metadata, sticky session) ra file để
+// server khởi động lại không phải bắt đầu từ pool rỗng. Thông tin đăng nhập upstream và
+// key ID được mã hóa AES-256-GCM bằng khóa dẫn xuất từ secret.
+type StateStore struct {
+	path   string
+	aead   cipher.AEAD
+	maxAge time.Duration
+}
+
+// poolState là nội dung file trạng thái
+type poolState struct {
+	Version  int            `json:"version"`
+	SavedAt  time.Time      `json:"saved_at"`
+	Proxies  []proxyState   `json:"proxies"`
+	Sessions []sessionState `json:"sessions"`
+	Events   []StateEvent   `json:"events,omitempty"`
+}
+
+// proxyState là một proxy trong file trạng thái, URL không chứa thông tin đăng nhập
+type proxyState struct {
+	URL            string        `json:"url"`
+	Credentials    string        `json:"credentials,omitempty"`
+	Type           ProxyType     `json:"type"`
+	Carrier        string        `json:"carrier,omitempty"`
+	Location       string        `json:"location,omitempty"`
+	Expiration     string        `json:"expiration,omitempty"`
+	ExpiresAt      time.Time     `json:"expires_at,omitempty"`
+	Tags           []string      `json:"tags,omitempty"`
+	Source         string        `json:"source,omitempty"`
+	Priority       int           `json:"priority"`
+	Weight         int           `json:"weight"`
+	AddedAt        time.Time     `json:"added_at"`
+	RefreshedAt    time.Time     `json:"refreshed_at"`
+	TTL            time.Duration `json:"ttl,omitempty"`
+	IsWorking      bool          `json:"is_working"`
+	FailCount      int           `json:"fail_count"`
+	State          ProxyState    `json:"state"`
+	StateChanged   time.Time     `json:"state_changed"`
+	RetryAt        time.Time     `json:"retry_at"`
+	Backoff        time.Duration `json:"backoff"`
+	TrialSuccesses int           `json:"trial_successes"`
+	LastChecked    time.Time     `json:"last_checked"`
+	LastCheckError string        `json:"last_check_error,omitempty"`
+	LastUsed       time.Time     `json:"last_used"`
+	Latency        time.Duration `json:"latency"`
+	TTFB           time.Duration `json:"ttfb"`
+	SuccessRate    float64       `json:"success_rate"`
+	Samples        int64         `json:"samples"`
+	Throughput     float64       `json:"throughput"`
+	Requests       int64         `json:"requests"`
+	Failures       int64         `json:"failures"`
+}
+
+// credentials là phần được mã hóa của proxyState. Key ID cũng được mã hóa vì là key API
+// dùng để lấy thông tin đăng nhập từ key manager.
+type credentials struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	AuthHeader string `json:"auth_header,omitempty"`
+	KeyID      string `json:"key_id,omitempty"`
+}
+
+// sessionState là một sticky session, trỏ tới proxy bằng ID của proxy (đã mã hóa vì ID chứa
+// key ID hoặc URL kèm thông tin đăng nhập); key ID của session lấy lại từ proxy khi khôi phục
+type sessionState struct {
+	Key       string    `json:"key"`
+	ProxyID   string    `json:"proxy_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewStateStore tạo store lưu trạng thái pool tại path. Snapshot cũ hơn maxAge (0 là không giới hạn)
+// bị bỏ qua khi khôi phục.
+func NewStateStore(path, secret string, maxAge time.Duration) (*StateStore, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("state encryption key is required")
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	return &StateStore{path: path, aead: aead, maxAge: maxAge}, nil
+}
+
+func (s *StateStore) encrypt(plaintext []byte) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *StateStore) decrypt(value string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	return s.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// parseStoredURL phân tích URL proxy, URL không có scheme được hiểu là http như dialProxy
+func parseStoredURL(rawURL string) (*url.URL, bool, error) {
+	hasScheme := strings.Contains(rawURL, "://")
+	if !hasScheme {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, false, urlParseError(err)
+	}
+	return u, hasScheme, nil
+}
+
+// formatStoredURL là chiều ngược của parseStoredURL, giữ nguyên URL không có scheme
+func formatStoredURL(u *url.URL, hasScheme bool) string {
+	if !hasScheme {
+		return strings.TrimPrefix(u.String(), "http://")
+	}
+	return u.String()
+}
+
+// stripCredentials bỏ thông tin đăng nhập khỏi URL proxy. URL không phân tích được bị trả lỗi
+// thay vì ghi nguyên văn vì có thể chứa mật khẩu.
+func stripCredentials(rawURL string) (string, error) {
+	u, hasScheme, err := parseStoredURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+	u.User = nil
+	return formatStoredURL(u, hasScheme), nil
+}
+
+// withCredentials gắn lại thông tin đăng nhập vào URL proxy như buildProxyURL
+func withCredentials(rawURL, username, password string) string {
+	u, hasScheme, err := parseStoredURL(rawURL)
+	if err != nil || username == "" {
+		return rawURL
+	}
+	u.User = userinfo(username, password)
+	return formatStoredURL(u, hasScheme)
+}
+
+// Save ghi trạng thái pool ra file (ghi file tạm rồi đổi tên)
+func (s *StateStore) Save(pm *ProxyManager) error {
+	state := poolState{Version: stateVersion, SavedAt: time.Now()}
+
+	pm.mu.RLock()
+	for _, p := range pm.proxies {
+		strippedURL, err := stripCredentials(p.URL)
+		if err != nil {
+			logger.Warn("Not saving proxy %s: invalid URL: %v", p.Redacted(), err)
+			continue
+		}
+
+		entry := proxyState{
+			URL:         strippedURL,
+			Type:        p.Type,
+			Carrier:     p.Carrier,
+			Location:    p.Location,
+			Expiration:  p.Expiration,
+			ExpiresAt:   p.ExpiresAt,
+			Tags:        p.Tags,
+			Source:      p.Source,
+			Priority:    p.Priority,
+			Weight:      p.Weight,
+			AddedAt:     p.AddedAt,
+			RefreshedAt: p.RefreshedAt,
+			TTL:         p.TTL,
+			LastUsed:    p.LastUsed(),
+			Latency:     p.Latency(),
+			TTFB:        p.TTFB(),
+			SuccessRate: p.SuccessRate(),
+			Samples:     p.Samples(),
+			Throughput:  p.Throughput(),
+			Requests:    atomic.LoadInt64(&p.Requests),
+			Failures:    atomic.LoadInt64(&p.Failures),
+		}
+
+		p.mu.Lock()
+		entry.IsWorking = p.IsWorking
+		entry.FailCount = p.FailCount
+		entry.State = p.State
+		entry.StateChanged = p.StateChanged
+		entry.RetryAt = p.RetryAt
+		entry.Backoff = p.Backoff
+		entry.TrialSuccesses = p.TrialSuccesses
+		entry.LastChecked = p.LastChecked
+		entry.LastCheckError = p.LastCheckError
+		p.mu.Unlock()
+
+		if p.Username != "" || p.Password != "" || p.AuthHeader != "" || p.KeyID != "" {
+			plaintext, _ := json.Marshal(credentials{Username: p.Username, Password: p.Password, AuthHeader: p.AuthHeader, KeyID: p.KeyID})
+			sealed, err := s.encrypt(plaintext)
+			if err != nil {
+				pm.mu.RUnlock()
+				return fmt.Errorf("failed to encrypt credentials: %v", err)
+			}
+			entry.Credentials = sealed
+		}
+		state.Proxies = append(state.Proxies, entry)
+	}
+
+	now := time.Now()
+	pm.sessionsMu.Lock()
+	for key, session := range pm.sessions {
+		p := pm.byURL[session.proxyURL]
+		if p == nil || now.After(session.expiresAt) {
+			continue
+		}
+		proxyID, err := s.encrypt([]byte(p.ID()))
+		if err != nil {
+			pm.sessionsMu.Unlock()
+			pm.mu.RUnlock()
+			return fmt.Errorf("failed to encrypt session proxy: %v", err)
+		}
+		state.Sessions = append(state.Sessions, sessionState{
+			Key:       key,
+			ProxyID:   proxyID,
+			CreatedAt: session.createdAt,
+			ExpiresAt: session.expiresAt,
+		})
+	}
+	pm.sessionsMu.Unlock()
+	pm.mu.RUnlock()
+
+	state.Events = pm.StateEvents()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode pool state: %v", err)
+	}
+
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write pool state: %v", err)
+	}
+	return nil
+}
+
+// Restore nạp trạng thái đã lưu vào pool. Gọi sau AddSource và trước StartSources để nguồn
+// đối chiếu lại danh sách đã khôi phục thay vì bắt đầu từ pool rỗng; proxy của nguồn
+// không còn trong cấu hình bị bỏ qua.
+func (s *StateStore) Restore(pm *ProxyManager) error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		logger.Info("No saved pool state at %s, starting with empty pool", s.path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read pool state: %v", err)
+	}
+
+	var state poolState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse pool state: %v", err)
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("unsupported pool state version %d", state.Version)
+	}
+	if s.maxAge > 0 && time.Since(state.SavedAt) > s.maxAge {
+		logger.Warn("Saved pool state from %s is older than %v, ignoring", state.SavedAt.Format(time.RFC3339), s.maxAge)
+		return nil
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	sources := make(map[string]bool)
+	for _, entry := range pm.sources {
+		sources[entry.source.Name()] = true
+	}
+
+	byID := make(map[string]*Proxy)
+	restored := 0
+	for _, entry := range state.Proxies {
+		if entry.Source != "" && !sources[entry.Source] {
+			continue
+		}
+
+		var creds credentials
+		if entry.Credentials != "" {
+			plaintext, err := s.decrypt(entry.Credentials)
+			if err == nil {
+				err = json.Unmarshal(plaintext, &creds)
+			}
+			if err != nil {
+				// Sai khóa hoặc file bị sửa: bỏ qua proxy thay vì dùng thông tin đăng nhập sai
+				logger.Warn("Skipping saved proxy %s: failed to decrypt credentials: %v", entry.URL, err)
+				continue
+			}
+		}
+
+		p := &Proxy{
+			URL:            withCredentials(entry.URL, creds.Username, creds.Password),
+			Username:       creds.Username,
+			Password:       creds.Password,
+			AuthHeader:     creds.AuthHeader,
+			Type:           entry.Type,
+			Carrier:        entry.Carrier,
+			Location:       entry.Location,
+			KeyID:          creds.KeyID,
+			Expiration:     entry.Expiration,
+			ExpiresAt:      entry.ExpiresAt,
+			Tags:           entry.Tags,
+			Source:         entry.Source,
+			Priority:       entry.Priority,
+			Weight:         entry.Weight,
+			AddedAt:        entry.AddedAt,
+			RefreshedAt:    entry.RefreshedAt,
+			TTL:            entry.TTL,
+			IsWorking:      entry.IsWorking,
+			FailCount:      entry.FailCount,
+			State:          entry.State,
+			StateChanged:   entry.StateChanged,
+			RetryAt:        entry.RetryAt,
+			Backoff:        entry.Backoff,
+			TrialSuccesses: entry.TrialSuccesses,
+			LastChecked:    entry.LastChecked,
+			LastCheckError: entry.LastCheckError,
+			Requests:       entry.Requests,
+			Failures:       entry.Failures,
+			metrics: proxyMetrics{
+				latency:     int64(entry.Latency),
+				ttfb:        int64(entry.TTFB),
+				successRate: math.Float64bits(entry.SuccessRate),
+				samples:     entry.Samples,
+				throughput:  math.Float64bits(entry.Throughput),
+			},
+		}
+		p.touch(entry.LastUsed)
+		if pm.proxyByID(p.ID()) != nil || pm.hasURL(p.URL) {
+			continue
+		}
+		pm.insert(p)
+		byID[p.ID()] = p
+		restored++
+	}
+
+	now := time.Now()
+	sessions := 0
+	pm.sessionsMu.Lock()
+	defer pm.sessionsMu.Unlock()
+	for _, entry := range state.Sessions {
+		if now.After(entry.ExpiresAt) {
+			continue
+		}
+		proxyID, err := s.decrypt(entry.ProxyID)
+		if err != nil {
+			continue
+		}
+		p, exists := byID[string(proxyID)]
+		if !exists {
+			continue
+		}
+		pm.sessions[entry.Key] = &stickySession{
+			proxyURL:  p.URL,
+			keyID:     p.KeyID,
+			createdAt: entry.CreatedAt,
+			expiresAt: entry.ExpiresAt,
+		}
+		sessions++
+	}
+
+	pm.eventsMu.Lock()
+	pm.stateEvents = append(state.Events, pm.stateEvents...)
+	if len(pm.stateEvents) > maxStateEvents {
+		pm.stateEvents = pm.stateEvents[len(pm.stateEvents)-maxStateEvents:]
+	}
+	pm.eventsMu.Unlock()
+
+	logger.Info("Restored %d proxies and %d sticky sessions from %s (saved %s)",
+		restored, sessions, s.path, state.SavedAt.Format(time.RFC3339))
+	return nil
+}
+
+// Run lưu trạng thái pool định kỳ
+func (s *StateStore) Run(pm *ProxyManager, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.Save(pm); err != nil {
+			logger.Error("Error saving pool state: %v", err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// Benchmark throughput của pool lớn dưới tải đồng thời, mỗi benchmark chạy song song trên
+// GOMAXPROCS goroutine:
+//
+//	go test ./proxy -run '^$' -bench . -cpu 8
+
+var benchPoolSizes = []int{1000, 10000, 50000}
+
+var benchCarriers = []string{"viettel", "vinaphone", "mobifone"}
+
+// newBenchPool tạo pool gồm size proxy datacenter giả lập, chia đều cho các nhà mạng
+func newBenchPool(size int) (*ProxyManager, []*Proxy) {
+	pm := NewProxyManager()
+	proxies := make([]*Proxy, 0, size)
+	for i := 0; i < size; i++ {
+		p := newBenchProxy(i, "pass")
+		pm.AddProxy(p)
+		proxies = append(proxies, p)
+	}
+	return pm, proxies
+}
+
+func newBenchProxy(i int, password string) *Proxy {
+	host := fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)
+	return &Proxy{
+		URL:       fmt.Sprintf("http://user:%s@%s:8080", password, host),
+		Username:  "user",
+		Password:  password,
+		Type:      ProxyTypeHTTP,
+		KeyID:     fmt.Sprintf("key-%08d", i),
+		Carrier:   benchCarriers[i%len(benchCarriers)],
+		Location:  "hanoi",
+		IsWorking: true,
+	}
+}
+
+// runPoolBenchmark chạy run với từng kích thước pool, log của pool bị tắt trong lúc đo
+func runPoolBenchmark(b *testing.B, run func(b *testing.B, pm *ProxyManager, proxies []*Proxy)) {
+	logger.SetOutput(io.Discard)
+	b.Cleanup(func() { logger.SetOutput(os.Stdout) })
+
+	for _, size := range benchPoolSizes {
+		b.Run(fmt.Sprintf("pool=%d", size), func(b *testing.B) {
+			pm, proxies := newBenchPool(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			run(b, pm, proxies)
+		})
+	}
+}
+
+func BenchmarkSelectProxy(b *testing.B) {
+	runPoolBenchmark(b, func(b *testing.B, pm *ProxyManager, _ []*Proxy) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if pm.GetRandomProxy() == nil {
+					b.Fatal("no proxy selected")
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkSelectRoute(b *testing.B) {
+	runPoolBenchmark(b, func(b *testing.B, pm *ProxyManager, _ []*Proxy) {
+		selector := SelectCarrier("Viettel")
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if pm.SelectProxy("", selector, nil) == nil {
+					b.Fatal("no proxy selected")
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkMarkProxySuccess(b *testing.B) {
+	runPoolBenchmark(b, func(b *testing.B, pm *ProxyManager, proxies []*Proxy) {
+		var next uint64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				i := atomic.AddUint64(&next, 1)
+				pm.MarkProxySuccess(proxies[i%uint64(len(proxies))])
+			}
+		})
+	})
+}
+
+func BenchmarkMarkProxyFailed(b *testing.B) {
+	runPoolBenchmark(b, func(b *testing.B, pm *ProxyManager, proxies []*Proxy) {
+		var next uint64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				i := atomic.AddUint64(&next, 1)
+				pm.MarkProxyFailed(proxies[i%uint64(len(proxies))])
+			}
+		})
+	})
+}
+
+func BenchmarkSelectAndMark(b *testing.B) {
+	runPoolBenchmark(b, func(b *testing.B, pm *ProxyManager, _ []*Proxy) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				p := pm.GetRandomProxy()
+				if p == nil {
+					b.Fatal("no proxy selected")
+				}
+				done := pm.TrackConnection(p)
+				pm.MarkProxySuccess(p)
+				done()
+			}
+		})
+	})
+}
+
+// BenchmarkAddProxy đo AddProxy với proxy đã có trong pool (cập nhật theo ID), như khi nguồn làm mới
+func BenchmarkAddProxy(b *testing.B) {
+	runPoolBenchmark(b, func(b *testing.B, pm *ProxyManager, proxies []*Proxy) {
+		var next uint64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				i := atomic.AddUint64(&next, 1) % uint64(len(proxies))
+				pm.AddProxy(newBenchProxy(int(i), "pass"))
+			}
+		})
+	})
+}
@@ -0,0 +1,576 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Định dạng của file danh sách proxy
+const (
+	// ProxyListText là mỗi dòng một proxy theo các định dạng ParseProxy nhận
+	ProxyListText = "text"
+	// ProxyListCSV là bảng có dòng tiêu đề, mỗi cột là một trường của ProxyListEntry
+	ProxyListCSV = "csv"
+	// ProxyListJSON là mảng ProxyListEntry hoặc object {"proxies": [...]}
+	ProxyListJSON = "json"
+	// ProxyListYAML là danh sách ProxyListEntry hoặc mapping proxies: [...]
+	ProxyListYAML = "yaml"
+)
+
+// ProxyListEntry là một proxy trong danh sách có cấu trúc (CSV/JSON/YAML).
+// Địa chỉ được ghi trong Proxy (mọi định dạng ParseProxy nhận) hoặc tách thành Host/Port.
+type ProxyListEntry struct {
+	Proxy    string    `json:"proxy" yaml:"proxy"`
+	Host     string    `json:"host" yaml:"host"`
+	Port     portValue `json:"port" yaml:"port"`
+	Username string    `json:"username" yaml:"username"`
+	Password string    `json:"password" yaml:"password"`
+	// Type là http, https, socks4, socks5 hoặc socks5h, bỏ trống thì dùng loại proxy của nguồn
+	Type   string `json:"type" yaml:"type"`
+	Weight int    `json:"weight" yaml:"weight"`
+	// Group và Groups là các group upstream mà proxy thuộc về (gắn như tag, xem groups.go)
+	Group      string   `json:"group" yaml:"group"`
+	Groups     []string `json:"groups" yaml:"groups"`
+	Tags       []string `json:"tags" yaml:"tags"`
+	Carrier    string   `json:"carrier" yaml:"carrier"`
+	Location   string   `json:"location" yaml:"location"`
+	KeyID      string   `json:"key_id" yaml:"key_id"`
+	Expiration string   `json:"expiration" yaml:"expiration"`
+}
+
+// proxyListFields là tên các trường của ProxyListEntry, dùng để báo cột/khóa lạ
+var proxyListFields = map[string]bool{
+	"proxy": true, "host": true, "port": true, "username": true, "password": true,
+	"type": true, "weight": true, "group": true, "groups": true, "tags": true,
+	"carrier": true, "location": true, "key_id": true, "expiration": true,
+}
+
+// portValue nhận port ghi dạng số hoặc chuỗi
+type portValue string
+
+func (p *portValue) UnmarshalJSON(data []byte) error {
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err == nil {
+		*p = portValue(number.String())
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("port must be a number or string")
+	}
+	*p = portValue(s)
+	return nil
+}
+
+// ProxyListError là lỗi của một mục trong danh sách proxy, Line tính từ 1
+type ProxyListError struct {
+	Line int
+	Err  error
+}
+
+func (e *ProxyListError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ProxyListError) Unwrap() error {
+	return e.Err
+}
+
+// ProxyList là kết quả đọc danh sách proxy: các proxy hợp lệ và lỗi của từng mục bị bỏ qua
+type ProxyList struct {
+	Proxies []*Proxy
+	Errors  []*ProxyListError
+}
+
+// DetectProxyListFormat đoán định dạng danh sách proxy theo phần mở rộng của tên file hoặc URL
+func DetectProxyListFormat(name string) string {
+	if u, err := url.Parse(name); err == nil && u.Scheme != "" && u.Host != "" {
+		name = u.Path
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".csv":
+		return ProxyListCSV
+	case ".json":
+		return ProxyListJSON
+	case ".yaml", ".yml":
+		return ProxyListYAML
+	default:
+		return ProxyListText
+	}
+}
+
+// ReadProxyListFile đọc file danh sách proxy, định dạng được đoán theo phần mở rộng
+func ReadProxyListFile(filename string, defaultType ProxyType) (*ProxyList, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open proxy list file: %v", err)
+	}
+	defer file.Close()
+
+	return ParseProxyList(file, DetectProxyListFormat(filename), defaultType)
+}
+
+// ParseProxyList đọc danh sách proxy theo format (rỗng là text). Mục sai định dạng được
+// bỏ qua và ghi vào ProxyList.Errors kèm số dòng; lỗi trả về chỉ khi không đọc được
+// cả danh sách (ví dụ JSON/YAML sai cú pháp).
+func ParseProxyList(r io.Reader, format string, defaultType ProxyType) (*ProxyList, error) {
+	b := &proxyListBuilder{defaultType: defaultType, seen: make(map[string]int)}
+
+	var err error
+	switch strings.ToLower(format) {
+	case "", ProxyListText:
+		err = b.readText(r)
+	case ProxyListCSV:
+		err = b.readCSV(r)
+	case ProxyListJSON:
+		err = b.readJSON(r)
+	case ProxyListYAML, "yml":
+		err = b.readYAML(r)
+	default:
+		return nil, fmt.Errorf("unknown proxy list format %q (expected text, csv, json or yaml)", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &b.list, nil
+}
+
+// proxyListBuilder gom proxy hợp lệ và lỗi theo dòng khi đọc danh sách
+type proxyListBuilder struct {
+	defaultType ProxyType
+	list        ProxyList
+	// seen ghi dòng đầu tiên của mỗi proxy ID để báo mục trùng
+	seen map[string]int
+}
+
+// add thêm proxy của dòng line hoặc ghi lại lỗi của mục đó
+func (b *proxyListBuilder) add(line int, p *Proxy, err error) {
+	if err == nil {
+		if first, exists := b.seen[p.ID()]; exists {
+			err = fmt.Errorf("duplicate proxy %s (first defined at line %d)", p.Redacted(), first)
+		}
+	}
+	if err != nil {
+		b.list.Errors = append(b.list.Errors, &ProxyListError{Line: line, Err: err})
+		return
+	}
+	b.seen[p.ID()] = line
+	p.IsWorking = true
+	b.list.Proxies = append(b.list.Proxies, p)
+}
+
+func (b *proxyListBuilder) readText(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := ParseProxy(line, b.defaultType)
+		b.add(lineNum, p, err)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read proxy list: %v", err)
+	}
+	return nil
+}
+
+// readCSV đọc bảng có dòng tiêu đề; group, groups và tags có nhiều giá trị ngăn cách bằng ';'
+func (b *proxyListBuilder) readCSV(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read proxy list header: %v", err)
+	}
+	headerLine, _ := reader.FieldPos(0)
+	for i, name := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(name))
+		if !proxyListFields[header[i]] {
+			return fmt.Errorf("line %d: unknown column %q", headerLine, name)
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			// Dòng sai cú pháp CSV (ví dụ thiếu dấu nháy đóng) không làm hỏng các dòng sau
+			b.add(parseErr.StartLine, nil, parseErr.Err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read proxy list: %v", err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) > len(header) {
+			b.add(line, nil, fmt.Errorf("expected at most %d fields, got %d", len(header), len(record)))
+			continue
+		}
+		entry, err := csvEntry(header, record)
+		if err != nil {
+			b.add(line, nil, err)
+			continue
+		}
+		p, err := entry.toProxy(b.defaultType)
+		b.add(line, p, err)
+	}
+}
+
+// csvEntry ghép các cột của một dòng CSV thành ProxyListEntry
+func csvEntry(header, record []string) (ProxyListEntry, error) {
+	var entry ProxyListEntry
+	for i, value := range record {
+		value = strings.TrimSpace(value)
+		switch header[i] {
+		case "proxy":
+			entry.Proxy = value
+		case "host":
+			entry.Host = value
+		case "port":
+			entry.Port = portValue(value)
+		case "username":
+			entry.Username = value
+		case "password":
+			entry.Password = value
+		case "type":
+			entry.Type = value
+		case "weight":
+			if value == "" {
+				continue
+			}
+			weight, err := strconv.Atoi(value)
+			if err != nil {
+				return entry, fmt.Errorf("invalid weight %q", value)
+			}
+			entry.Weight = weight
+		case "group", "groups":
+			entry.Groups = append(entry.Groups, splitList(value)...)
+		case "tags":
+			entry.Tags = splitList(value)
+		case "carrier":
+			entry.Carrier = value
+		case "location":
+			entry.Location = value
+		case "key_id":
+			entry.KeyID = value
+		case "expiration":
+			entry.Expiration = value
+		}
+	}
+	return entry, nil
+}
+
+// splitList tách danh sách ngăn cách bằng ';', bỏ phần tử rỗng
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ";") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// readJSON đọc mảng các mục hoặc object {"proxies": [...]}, số dòng tính từ vị trí của từng mục
+func (b *proxyListBuilder) readJSON(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read proxy list: %v", err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	lineAt := func(offset int64) int {
+		return bytes.Count(data[:offset], []byte("\n")) + 1
+	}
+	syntaxError := func(err error) error {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return fmt.Errorf("line %d: invalid JSON: %v", lineAt(syntaxErr.Offset), syntaxErr)
+		}
+		return fmt.Errorf("line %d: invalid JSON: %v", lineAt(dec.InputOffset()), err)
+	}
+
+	token, err := dec.Token()
+	if err != nil {
+		return syntaxError(err)
+	}
+	if token == json.Delim('{') {
+		// Object chỉ có khóa proxies chứa mảng các mục
+		found := false
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return syntaxError(err)
+			}
+			if key != "proxies" {
+				return fmt.Errorf("line %d: unknown key %q (expected \"proxies\")", lineAt(dec.InputOffset()), key)
+			}
+			if token, err = dec.Token(); err != nil {
+				return syntaxError(err)
+			}
+			if token != json.Delim('[') {
+				return fmt.Errorf("line %d: \"proxies\" must be an array", lineAt(dec.InputOffset()))
+			}
+			if err := b.readJSONEntries(dec, data, lineAt, syntaxError); err != nil {
+				return err
+			}
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("missing \"proxies\" array")
+		}
+		return nil
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("line 1: proxy list must be an array or an object with \"proxies\"")
+	}
+	return b.readJSONEntries(dec, data, lineAt, syntaxError)
+}
+
+// readJSONEntries đọc các mục của mảng JSON đã mở tới dấu ']' đóng mảng
+func (b *proxyListBuilder) readJSONEntries(dec *json.Decoder, data []byte, lineAt func(int64) int, syntaxError func(error) error) error {
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return syntaxError(err)
+		}
+		// raw kết thúc tại InputOffset, vị trí bắt đầu của mục là ở đó trừ độ dài raw
+		line := lineAt(dec.InputOffset() - int64(len(raw)))
+
+		var p *Proxy
+		entry, err := decodeJSONEntry(raw)
+		if err == nil {
+			p, err = entry.toProxy(b.defaultType)
+		}
+		b.add(line, p, err)
+	}
+	if _, err := dec.Token(); err != nil {
+		return syntaxError(err)
+	}
+	return nil
+}
+
+// decodeJSONEntry giải mã một mục JSON, mục có thể là chuỗi proxy hoặc object
+func decodeJSONEntry(raw json.RawMessage) (ProxyListEntry, error) {
+	var entry ProxyListEntry
+	if s := ""; json.Unmarshal(raw, &s) == nil {
+		entry.Proxy = s
+		return entry, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&entry); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return entry, fmt.Errorf("invalid value for %q: expected %s", typeErr.Field, typeErr.Type)
+		}
+		return entry, errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return entry, nil
+}
+
+// readYAML đọc danh sách các mục hoặc mapping proxies: [...], số dòng lấy từ node của từng mục
+func (b *proxyListBuilder) readYAML(r io.Reader) error {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return fmt.Errorf("invalid YAML: %v", err)
+	}
+
+	root := &doc
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = root.Content[0]
+	}
+	if root.Kind == yaml.MappingNode {
+		var list *yaml.Node
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			key := root.Content[i]
+			if key.Value != "proxies" {
+				return fmt.Errorf("line %d: unknown key %q (expected \"proxies\")", key.Line, key.Value)
+			}
+			list = root.Content[i+1]
+		}
+		if list == nil {
+			return fmt.Errorf("missing \"proxies\" list")
+		}
+		root = list
+	}
+	if root.Kind != yaml.SequenceNode {
+		return fmt.Errorf("line %d: proxy list must be a sequence or a mapping with \"proxies\"", root.Line)
+	}
+
+	for _, item := range root.Content {
+		var p *Proxy
+		entry, err := decodeYAMLEntry(item)
+		if err == nil {
+			p, err = entry.toProxy(b.defaultType)
+		}
+		b.add(item.Line, p, err)
+	}
+	return nil
+}
+
+// decodeYAMLEntry giải mã một mục YAML, mục có thể là chuỗi proxy hoặc mapping
+func decodeYAMLEntry(node *yaml.Node) (ProxyListEntry, error) {
+	var entry ProxyListEntry
+	switch node.Kind {
+	case yaml.ScalarNode:
+		entry.Proxy = node.Value
+		return entry, nil
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if key := node.Content[i].Value; !proxyListFields[key] {
+				return entry, fmt.Errorf("unknown field %q", key)
+			}
+		}
+		if err := node.Decode(&entry); err != nil {
+			var typeErr *yaml.TypeError
+			if errors.As(err, &typeErr) && len(typeErr.Errors) > 0 {
+				// Bỏ tiền tố "line N: " vì lỗi đã được gắn số dòng của mục
+				message := typeErr.Errors[0]
+				if _, rest, ok := strings.Cut(message, ": "); ok && strings.HasPrefix(message, "line ") {
+					message = rest
+				}
+				return entry, errors.New(message)
+			}
+			return entry, err
+		}
+		return entry, nil
+	default:
+		return entry, fmt.Errorf("entry must be a proxy string or a mapping")
+	}
+}
+
+// proxyListSchemes là các giá trị type của một mục và loại proxy tương ứng
+var proxyListSchemes = map[string]ProxyType{
+	"http":    ProxyTypeHTTP,
+	"https":   ProxyTypeHTTP,
+	"socks4":  ProxyTypeSOCKS4,
+	"socks5":  ProxyTypeSOCKS5,
+	"socks5h": ProxyTypeSOCKS5,
+}
+
+// toProxy kiểm tra mục và tạo Proxy với loại, weight, group và metadata của mục
+func (e ProxyListEntry) toProxy(defaultType ProxyType) (*Proxy, error) {
+	scheme := strings.ToLower(strings.TrimSpace(e.Type))
+	if _, ok := proxyListSchemes[scheme]; scheme != "" && !ok {
+		return nil, fmt.Errorf("invalid type %q (expected http, https, socks4, socks5 or socks5h)", e.Type)
+	}
+	if e.Username == "" && e.Password != "" {
+		return nil, fmt.Errorf("password set without username")
+	}
+
+	var line string
+	switch {
+	case e.Proxy != "" && (e.Host != "" || e.Port != ""):
+		return nil, fmt.Errorf("set either proxy or host/port, not both")
+	case e.Proxy != "":
+		line = strings.TrimSpace(e.Proxy)
+		if scheme != "" && !strings.Contains(line, "://") {
+			line = scheme + "://" + line
+		}
+	case e.Host != "":
+		if e.Port == "" {
+			return nil, fmt.Errorf("missing port for host %q", e.Host)
+		}
+		if scheme == "" {
+			scheme = "http"
+			switch defaultType {
+			case ProxyTypeSOCKS5:
+				scheme = "socks5"
+			case ProxyTypeSOCKS4:
+				scheme = "socks4"
+			}
+		}
+		// Thông tin đăng nhập được gắn sau để ParseProxy chỉ kiểm tra host và port
+		line = scheme + "://" + joinEntryHostPort(strings.TrimSpace(e.Host), strings.TrimSpace(string(e.Port)))
+	default:
+		return nil, fmt.Errorf("missing proxy address (set proxy or host and port)")
+	}
+
+	p, err := ParseProxy(line, defaultType)
+	if err != nil {
+		return nil, err
+	}
+	if scheme != "" && proxyListSchemes[scheme] != p.Type {
+		return nil, fmt.Errorf("type %q does not match proxy scheme", e.Type)
+	}
+	// Chỉ socks4 nhận username không mật khẩu (user ID)
+	if e.Username != "" && e.Password == "" && p.Type != ProxyTypeSOCKS4 {
+		return nil, fmt.Errorf("username and password must be set together")
+	}
+	if e.Username != "" {
+		if p.Username != "" {
+			return nil, fmt.Errorf("credentials set both in proxy and in username/password")
+		}
+		p.Username, p.Password = e.Username, e.Password
+		p.URL = withCredentials(p.URL, e.Username, e.Password)
+	}
+
+	if e.Weight < 0 {
+		return nil, fmt.Errorf("invalid weight %d (must not be negative)", e.Weight)
+	}
+	p.Weight = e.Weight
+	p.Carrier = strings.TrimSpace(e.Carrier)
+	p.Location = strings.TrimSpace(e.Location)
+	p.KeyID = strings.TrimSpace(e.KeyID)
+	if e.Expiration != "" {
+		expiresAt, err := parseExpiration(e.Expiration)
+		if err != nil {
+			return nil, err
+		}
+		p.Expiration = e.Expiration
+		p.ExpiresAt = expiresAt
+	}
+
+	groups := e.Groups
+	if e.Group != "" {
+		groups = append([]string{e.Group}, groups...)
+	}
+	for _, tag := range append(e.Tags, groups...) {
+		if tag = strings.TrimSpace(tag); tag != "" && !p.HasTag(tag) {
+			p.Tags = append(p.Tags, tag)
+		}
+	}
+	return p, nil
+}
+
+// joinEntryHostPort ghép host và port, IPv6 chưa có ngoặc vuông được đặt trong ngoặc
+func joinEntryHostPort(host, port string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		host = "[" + host + "]"
+	}
+	return host + ":" + port
+}
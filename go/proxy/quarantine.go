@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ProxyState là trạng thái sức khỏe của proxy trong pool
+type ProxyState string
+
+const (
+	// ProxyStateHealthy: proxy hoạt động bình thường
+	ProxyStateHealthy ProxyState = "healthy"
+	// ProxyStateDegraded: proxy vừa lỗi, vẫn được chọn nhưng sau các proxy healthy
+	ProxyStateDegraded ProxyState = "degraded"
+	// ProxyStateQuarantined: proxy lỗi liên tiếp quá ngưỡng, chỉ được probe lại theo backoff
+	ProxyStateQuarantined ProxyState = "quarantined"
+	// ProxyStateHalfOpen: probe lại thành công, proxy nhận thử từng kết nối traffic thật
+	ProxyStateHalfOpen ProxyState = "half-open"
+)
+
+// Giá trị của Proxy.status, bản sao atomic của trạng thái để chọn proxy không cần khóa proxy
+const (
+	statusHealthy int32 = iota
+	statusDegraded
+	statusHalfOpen
+	// statusDown: proxy đang bị cách ly hoặc không hoạt động
+	statusDown
+)
+
+// QuarantineOptions cấu hình cách cách ly và đưa proxy lỗi trở lại pool
+type QuarantineOptions struct {
+	// BaseBackoff là thời gian cách ly lần đầu, nhân đôi mỗi lần bị cách ly lại
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// RecoverySuccesses là số request thành công liên tiếp ở half-open để trở lại healthy
+	RecoverySuccesses int
+}
+
+// trialTimeout là thời gian giữ chỗ kết nối thử của proxy half-open; quá thời gian này mà chưa
+// có kết quả (ví dụ proxy được chọn nhưng không dùng tới) thì chỗ được nhường cho request khác
+const trialTimeout = time.Minute
+
+// maxStateEvents là số sự kiện chuyển trạng thái gần nhất được giữ lại
+const maxStateEvents = 200
+
+// StateEvent là một lần chuyển trạng thái của proxy
+type StateEvent struct {
+	Time    time.Time     `json:"time"`
+	Proxy   string        `json:"proxy"`
+	KeyID   string        `json:"key_id,omitempty"`
+	From    ProxyState    `json:"from"`
+	To      ProxyState    `json:"to"`
+	Reason  string        `json:"reason"`
+	Backoff time.Duration `json:"backoff,omitempty"`
+}
+
+// state trả về trạng thái của proxy, proxy mới chưa có trạng thái là healthy (gọi khi đang giữ mu của proxy)
+func (p *Proxy) state() ProxyState {
+	if p.State == "" {
+		return ProxyStateHealthy
+	}
+	return p.State
+}
+
+// publishStatus cập nhật bản sao atomic của trạng thái sau khi State hoặc IsWorking đổi
+// (gọi khi đang giữ mu của proxy)
+func (p *Proxy) publishStatus() {
+	status := statusHealthy
+	switch {
+	case !p.IsWorking || p.state() == ProxyStateQuarantined:
+		status = statusDown
+	case p.state() == ProxyStateDegraded:
+		status = statusDegraded
+	case p.state() == ProxyStateHalfOpen:
+		status = statusHalfOpen
+	}
+	atomic.StoreInt32(&p.status, status)
+}
+
+func (p *Proxy) loadStatus() int32 {
+	return atomic.LoadInt32(&p.status)
+}
+
+// SetQuarantineOptions đặt cấu hình cách ly, giá trị 0 giữ mặc định
+func (pm *ProxyManager) SetQuarantineOptions(options QuarantineOptions) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if options.BaseBackoff > 0 {
+		pm.quarantine.BaseBackoff = options.BaseBackoff
+	}
+	if options.MaxBackoff > 0 {
+		pm.quarantine.MaxBackoff = options.MaxBackoff
+	}
+	if options.RecoverySuccesses > 0 {
+		pm.quarantine.RecoverySuccesses = options.RecoverySuccesses
+	}
+}
+
+// OnStateChange đăng ký hàm nhận sự kiện chuyển trạng thái. Hàm được gọi trong goroutine riêng
+// nên không đảm bảo thứ tự, dùng StateEvents khi cần lịch sử theo thứ tự.
+func (pm *ProxyManager) OnStateChange(listener func(StateEvent)) {
+	pm.eventsMu.Lock()
+	defer pm.eventsMu.Unlock()
+	pm.stateListeners = append(pm.stateListeners, listener)
+}
+
+// StateEvents trả về các sự kiện chuyển trạng thái gần nhất, cũ trước
+func (pm *ProxyManager) StateEvents() []StateEvent {
+	pm.eventsMu.Lock()
+	defer pm.eventsMu.Unlock()
+	return append([]StateEvent(nil), pm.stateEvents...)
+}
+
+// transition chuyển proxy sang trạng thái mới, ghi log và phát sự kiện (gọi khi đang giữ mu của proxy)
+func (pm *ProxyManager) transition(p *Proxy, to ProxyState, reason string) {
+	from := p.state()
+	if from == to {
+		return
+	}
+
+	p.State = to
+	p.StateChanged = time.Now()
+	p.IsWorking = to != ProxyStateQuarantined
+	p.publishStatus()
+	p.releaseTrial()
+
+	event := StateEvent{
+		Time:   p.StateChanged,
+		Proxy:  p.Redacted(),
+		From:   from,
+		To:     to,
+		Reason: reason,
+	}
+	if p.KeyID != "" {
+		event.KeyID = maskKey(p.KeyID)
+	}
+
+	if to == ProxyStateQuarantined {
+		event.Backoff = p.Backoff
+		logger.Warn("Proxy %s %s -> %s (%s), re-probe in %v", p.Describe(), from, to, reason, p.Backoff)
+	} else {
+		logger.Info("Proxy %s %s -> %s (%s)", p.Describe(), from, to, reason)
+	}
+
+	pm.eventsMu.Lock()
+	defer pm.eventsMu.Unlock()
+	pm.stateEvents = append(pm.stateEvents, event)
+	if len(pm.stateEvents) > maxStateEvents {
+		pm.stateEvents = pm.stateEvents[len(pm.stateEvents)-maxStateEvents:]
+	}
+	for _, listener := range pm.stateListeners {
+		go listener(event)
+	}
+}
+
+// recordSuccess ghi nhận một lần thành công của proxy (gọi khi đang giữ pm.mu để đọc và mu của proxy).
+// Chỉ probe chủ động mới đưa proxy đang cách ly sang half-open.
+func (pm *ProxyManager) recordSuccess(p *Proxy, probe bool) {
+	switch p.state() {
+	case ProxyStateDegraded:
+		p.FailCount = 0
+		pm.transition(p, ProxyStateHealthy, "request succeeded")
+	case ProxyStateQuarantined:
+		if probe {
+			p.FailCount = 0
+			p.TrialSuccesses = 0
+			pm.transition(p, ProxyStateHalfOpen, "re-probe succeeded")
+		}
+	case ProxyStateHalfOpen:
+		if !probe {
+			p.TrialSuccesses++
+			if p.TrialSuccesses >= pm.quarantine.RecoverySuccesses {
+				p.Backoff = 0
+				pm.transition(p, ProxyStateHealthy, "trial traffic succeeded")
+			}
+		}
+	default:
+		p.FailCount = 0
+	}
+}
+
+// recordFailure ghi nhận một lần lỗi của proxy (gọi khi đang giữ pm.mu để đọc và mu của proxy)
+func (pm *ProxyManager) recordFailure(p *Proxy, probe bool, reason string) {
+	switch p.state() {
+	case ProxyStateHealthy, ProxyStateDegraded:
+		p.FailCount++
+		if p.FailCount >= pm.failThresholdFor(p) {
+			pm.quarantineProxy(p, reason)
+		} else {
+			pm.transition(p, ProxyStateDegraded, reason)
+		}
+	case ProxyStateHalfOpen:
+		p.FailCount++
+		pm.quarantineProxy(p, "trial failed: "+reason)
+	case ProxyStateQuarantined:
+		// Lỗi của kết nối mở trước khi bị cách ly không tính, chỉ probe lại mới gia hạn cách ly
+		if probe {
+			p.FailCount++
+			pm.quarantineProxy(p, "re-probe failed: "+reason)
+		}
+	}
+}
+
+// quarantineProxy cách ly proxy với backoff tăng gấp đôi mỗi lần (gọi khi đang giữ pm.mu và mu của proxy)
+func (pm *ProxyManager) quarantineProxy(p *Proxy, reason string) {
+	backoff := pm.quarantine.BaseBackoff
+	if p.Backoff > 0 {
+		backoff = p.Backoff * 2
+	}
+	if backoff > pm.quarantine.MaxBackoff {
+		backoff = pm.quarantine.MaxBackoff
+	}
+	p.Backoff = backoff
+	p.RetryAt = time.Now().Add(backoff)
+
+	if p.state() == ProxyStateQuarantined {
+		logger.Warn("Proxy %s stays quarantined (%s), re-probe in %v", p.Describe(), reason, backoff)
+		return
+	}
+	pm.transition(p, ProxyStateQuarantined, reason)
+}
+
+// resetState đưa proxy về healthy, dùng khi key đổi IP hoặc thông tin đăng nhập (gọi khi đang giữ mu của proxy)
+func (pm *ProxyManager) resetState(p *Proxy, reason string) {
+	p.FailCount = 0
+	p.Backoff = 0
+	p.TrialSuccesses = 0
+	pm.transition(p, ProxyStateHealthy, reason)
+	p.IsWorking = true
+	p.publishStatus()
+}
+
+// admitsTraffic cho biết proxy có nhận thêm traffic được không tại thời điểm now (unix nano):
+// proxy bị cách ly thì không, proxy half-open chỉ khi chưa có kết nối thử nào đang giữ chỗ.
+// Chỉ đọc atomic nên không cần khóa; chỗ thử thật sự được giữ bằng reserveTrial.
+func (p *Proxy) admitsTraffic(now int64) bool {
+	switch p.loadStatus() {
+	case statusDown:
+		return false
+	case statusHalfOpen:
+		return p.trialFree(atomic.LoadInt64(&p.trialSince), now)
+	default:
+		return true
+	}
+}
+
+func (p *Proxy) trialFree(since, now int64) bool {
+	return since == 0 || now-since >= int64(trialTimeout)
+}
+
+// reserveTrial giữ chỗ kết nối thử khi proxy half-open được chọn, trả về false nếu request khác
+// đã giữ chỗ trước. Proxy ở trạng thái khác không cần giữ chỗ. Chỗ được nhả khi kết quả của
+// request được ghi nhận (MarkProxySuccess, MarkProxyFailed) hoặc proxy chuyển trạng thái.
+func (p *Proxy) reserveTrial(now int64) bool {
+	if p.loadStatus() != statusHalfOpen {
+		return true
+	}
+	since := atomic.LoadInt64(&p.trialSince)
+	return p.trialFree(since, now) && atomic.CompareAndSwapInt64(&p.trialSince, since, now)
+}
+
+// releaseTrial nhả chỗ kết nối thử của proxy
+func (p *Proxy) releaseTrial() {
+	if atomic.LoadInt64(&p.trialSince) != 0 {
+		atomic.StoreInt64(&p.trialSince, 0)
+	}
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newQuarantineManager(t *testing.T) (*ProxyManager, *Proxy) {
+	t.Helper()
+	pm := NewProxyManager()
+	pm.SetMaxFails(2)
+	pm.SetQuarantineOptions(QuarantineOptions{
+		BaseBackoff:       time.Second,
+		MaxBackoff:        4 * time.Second,
+		RecoverySuccesses: 2,
+	})
+	pm.AddProxy(&Proxy{URL: "http://10.0.0.1:8080", Type: ProxyTypeHTTP, IsWorking: true})
+	p := pm.proxyByID("http://10.0.0.1:8080")
+	if p == nil {
+		t.Fatal("proxy not added")
+	}
+	return pm, p
+}
+
+type stateStep struct {
+	success bool
+	probe   bool
+	state   ProxyState
+	backoff time.Duration
+}
+
+func TestQuarantineStateMachine(t *testing.T) {
+	fail := func(probe bool, state ProxyState, backoff time.Duration) stateStep {
+		return stateStep{probe: probe, state: state, backoff: backoff}
+	}
+	ok := func(probe bool, state ProxyState, backoff time.Duration) stateStep {
+		return stateStep{success: true, probe: probe, state: state, backoff: backoff}
+	}
+
+	tests := []struct {
+		name   string
+		steps  []stateStep
+		events []string
+	}{
+		{
+			name: "degraded recovers on success",
+			steps: []stateStep{
+				fail(false, ProxyStateDegraded, 0),
+				ok(false, ProxyStateHealthy, 0),
+			},
+			events: []string{"healthy->degraded", "degraded->healthy"},
+		},
+		{
+			name: "threshold quarantines",
+			steps: []stateStep{
+				fail(false, ProxyStateDegraded, 0),
+				fail(false, ProxyStateQuarantined, time.Second),
+			},
+			events: []string{"healthy->degraded", "degraded->quarantined"},
+		},
+		{
+			name: "traffic results ignored while quarantined",
+			steps: []stateStep{
+				fail(true, ProxyStateDegraded, 0),
+				fail(true, ProxyStateQuarantined, time.Second),
+				ok(false, ProxyStateQuarantined, time.Second),
+				fail(false, ProxyStateQuarantined, time.Second),
+			},
+			events: []string{"healthy->degraded", "degraded->quarantined"},
+		},
+		{
+			name: "re-probe failures double backoff up to max",
+			steps: []stateStep{
+				fail(false, ProxyStateDegraded, 0),
+				fail(false, ProxyStateQuarantined, time.Second),
+				fail(true, ProxyStateQuarantined, 2*time.Second),
+				fail(true, ProxyStateQuarantined, 4*time.Second),
+				fail(true, ProxyStateQuarantined, 4*time.Second),
+			},
+			events: []string{"healthy->degraded", "degraded->quarantined"},
+		},
+		{
+			name: "half-open recovers after trial successes",
+			steps: []stateStep{
+				fail(false, ProxyStateDegraded, 0),
+				fail(false, ProxyStateQuarantined, time.Second),
+				ok(true, ProxyStateHalfOpen, time.Second),
+				ok(true, ProxyStateHalfOpen, time.Second),
+				ok(false, ProxyStateHalfOpen, time.Second),
+				ok(false, ProxyStateHealthy, 0),
+			},
+			events: []string{"healthy->degraded", "degraded->quarantined", "quarantined->half-open", "half-open->healthy"},
+		},
+		{
+			name: "half-open trial failure re-quarantines with longer backoff",
+			steps: []stateStep{
+				fail(false, ProxyStateDegraded, 0),
+				fail(false, ProxyStateQuarantined, time.Second),
+				ok(true, ProxyStateHalfOpen, time.Second),
+				ok(false, ProxyStateHalfOpen, time.Second),
+				fail(false, ProxyStateQuarantined, 2*time.Second),
+			},
+			events: []string{"healthy->degraded", "degraded->quarantined", "quarantined->half-open", "half-open->quarantined"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm, p := newQuarantineManager(t)
+			prev := ProxyStateHealthy
+			for i, step := range tt.steps {
+				before := time.Now()
+				pm.mu.RLock()
+				p.mu.Lock()
+				if step.success {
+					pm.recordSuccess(p, step.probe)
+				} else {
+					pm.recordFailure(p, step.probe, "test")
+				}
+				state, backoff, retryAt, working := p.state(), p.Backoff, p.RetryAt, p.IsWorking
+				p.mu.Unlock()
+				pm.mu.RUnlock()
+
+				if state != step.state || backoff != step.backoff {
+					t.Fatalf("step %d: state %s backoff %v, want %s %v", i, state, backoff, step.state, step.backoff)
+				}
+				if working != (state != ProxyStateQuarantined) {
+					t.Fatalf("step %d: IsWorking = %v in state %s", i, working, state)
+				}
+				// RetryAt được đặt mỗi khi proxy bị cách ly hoặc probe lại lỗi
+				if state == ProxyStateQuarantined && !step.success && (step.probe || prev != ProxyStateQuarantined) {
+					if retryAt.Before(before.Add(backoff)) || retryAt.After(time.Now().Add(backoff)) {
+						t.Fatalf("step %d: RetryAt %v not %v after the failure", i, retryAt, backoff)
+					}
+				}
+				prev = state
+			}
+
+			events := pm.StateEvents()
+			if len(events) != len(tt.events) {
+				t.Fatalf("got %d events %v, want %v", len(events), events, tt.events)
+			}
+			for i, event := range events {
+				if got := string(event.From) + "->" + string(event.To); got != tt.events[i] {
+					t.Fatalf("event %d = %s, want %s", i, got, tt.events[i])
+				}
+				if event.To == ProxyStateQuarantined && event.Backoff == 0 {
+					t.Fatalf("event %d: quarantine event without backoff", i)
+				}
+			}
+		})
+	}
+}
+
+// setHalfOpen đưa proxy qua cách ly rồi probe lại thành công
+func setHalfOpen(pm *ProxyManager, p *Proxy) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pm.quarantineProxy(p, "test")
+	p.RetryAt = time.Time{}
+	pm.recordSuccess(p, true)
+}
+
+func TestHalfOpenReservesSingleTrial(t *testing.T) {
+	pm, p := newQuarantineManager(t)
+	setHalfOpen(pm, p)
+
+	// Các request chọn proxy song song chỉ một request được giữ chỗ thử,
+	// dù chưa request nào mở kết nối qua proxy
+	var selected int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if pm.GetRandomProxy() != nil {
+				atomic.AddInt32(&selected, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if selected != 1 {
+		t.Fatalf("%d requests selected the half-open proxy, want 1", selected)
+	}
+
+	pm.MarkProxySuccess(p)
+	got := pm.GetRandomProxy()
+	if got != p {
+		t.Fatal("trial slot not released after the result was recorded")
+	}
+	if pm.GetRandomProxy() != nil {
+		t.Fatal("second trial admitted while the first is in progress")
+	}
+
+	// Chỗ thử không có kết quả được nhường lại sau trialTimeout
+	atomic.StoreInt64(&p.trialSince, time.Now().Add(-trialTimeout).UnixNano())
+	if pm.GetRandomProxy() != p {
+		t.Fatal("abandoned trial slot not reclaimed")
+	}
+}
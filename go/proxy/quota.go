@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaLimits giới hạn lưu lượng và số request của một user (0 là không giới hạn)
+type QuotaLimits struct {
+	DailyBytes      int64 `json:"daily_bytes"`
+	MonthlyBytes    int64 `json:"monthly_bytes"`
+	DailyRequests   int64 `json:"daily_requests"`
+	MonthlyRequests int64 `json:"monthly_requests"`
+}
+
+// QuotaUsage lượng đã sử dụng của user trong ngày và tháng hiện tại
+type QuotaUsage struct {
+	Day             string `json:"day"`
+	Month           string `json:"month"`
+	DailyBytes      int64  `json:"daily_bytes"`
+	MonthlyBytes    int64  `json:"monthly_bytes"`
+	DailyRequests   int64  `json:"daily_requests"`
+	MonthlyRequests int64  `json:"monthly_requests"`
+}
+
+// QuotaManager theo dõi và giới hạn lưu lượng của từng user
+type QuotaManager struct {
+	limitsPath string
+	statePath  string
+	mu         sync.Mutex
+	limits     map[string]QuotaLimits
+	overrides  map[string]QuotaLimits
+	usage      map[string]*QuotaUsage
+	modTime    time.Time
+	dirty      bool
+}
+
+var quotas *QuotaManager
+
+// ConfigureQuota bật giới hạn quota cho các handler
+func ConfigureQuota(q *QuotaManager) {
+	if q != nil {
+		quotas = q
+	}
+}
+
+// NewQuotaManager tải giới hạn từ limitsPath và lượng đã dùng từ statePath
+func NewQuotaManager(limitsPath, statePath string) (*QuotaManager, error) {
+	q := &QuotaManager{
+		limitsPath: limitsPath,
+		statePath:  statePath,
+		limits:     make(map[string]QuotaLimits),
+		overrides:  make(map[string]QuotaLimits),
+		usage:      make(map[string]*QuotaUsage),
+	}
+
+	if err := q.LoadLimits(); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(statePath)
+	if err == nil {
+		if err := json.Unmarshal(data, &q.usage); err != nil {
+			return nil, fmt.Errorf("failed to parse quota state: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read quota state: %v", err)
+	}
+
+	return q, nil
+}
+
+// LoadLimits đọc lại file giới hạn quota (JSON: username -> QuotaLimits)
+func (q *QuotaManager) LoadLimits() error {
+	stat, err := os.Stat(q.limitsPath)
+	if os.IsNotExist(err) {
+		// Không có file thì chỉ áp dụng giới hạn do authenticator trả về
+		logger.Warn("Quota file %s not found, using authenticator limits only", q.limitsPath)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat quota file: %v", err)
+	}
+
+	data, err := os.ReadFile(q.limitsPath)
+	if err != nil {
+		return fmt.Errorf("failed to read quota file: %v", err)
+	}
+
+	limits := make(map[string]QuotaLimits)
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return fmt.Errorf("failed to parse quota file: %v", err)
+	}
+
+	q.mu.Lock()
+	q.limits = limits
+	q.modTime = stat.ModTime()
+	q.mu.Unlock()
+
+	logger.Info("Loaded quota limits for %d users from %s", len(limits), q.limitsPath)
+	return nil
+}
+
+// Save ghi lượng đã dùng ra file để giữ lại sau khi khởi động lại
+func (q *QuotaManager) Save() error {
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(q.usage, "", "  ")
+	q.dirty = false
+	q.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to encode quota state: %v", err)
+	}
+
+	tmp := q.statePath + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, q.statePath)
+	}
+	if err != nil {
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+		return fmt.Errorf("failed to write quota state: %v", err)
+	}
+	return nil
+}
+
+// Run lưu trạng thái định kỳ và tải lại giới hạn khi file thay đổi
+func (q *QuotaManager) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := q.Save(); err != nil {
+			logger.Error("Error saving quota state: %v", err)
+		}
+
+		stat, err := os.Stat(q.limitsPath)
+		if err != nil {
+			continue
+		}
+
+		q.mu.Lock()
+		changed := !stat.ModTime().Equal(q.modTime)
+		q.mu.Unlock()
+
+		if changed {
+			logger.Info("Quota file %s changed, reloading", q.limitsPath)
+			if err := q.LoadLimits(); err != nil {
+				logger.Error("Error reloading quota limits: %v", err)
+			}
+		}
+	}
+}
+
+// SetLimits ghi đè giới hạn của user (ví dụ giới hạn do callback xác thực trả về)
+func (q *QuotaManager) SetLimits(username string, limits QuotaLimits) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.overrides[username] = limits
+}
+
+// ClearLimits bỏ giới hạn ghi đè của user, user quay về giới hạn trong file quota
+func (q *QuotaManager) ClearLimits(username string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.overrides, username)
+}
+
+// limitsFor trả về giới hạn đang áp dụng cho user (gọi khi đang giữ mu)
+func (q *QuotaManager) limitsFor(username string) (QuotaLimits, bool) {
+	if limits, exists := q.overrides[username]; exists {
+		return limits, true
+	}
+	limits, exists := q.limits[username]
+	return limits, exists
+}
+
+// currentUsage trả về usage của user, reset khi sang ngày/tháng mới (gọi khi đang giữ mu)
+func (q *QuotaManager) currentUsage(username string) *QuotaUsage {
+	now := time.Now()
+	day := now.Format("2006-01-02")
+	month := now.Format("2006-01")
+
+	usage, exists := q.usage[username]
+	if !exists {
+		usage = &QuotaUsage{Day: day, Month: month}
+		q.usage[username] = usage
+	}
+
+	if usage.Month != month {
+		usage.Month = month
+		usage.MonthlyBytes = 0
+		usage.MonthlyRequests = 0
+	}
+	if usage.Day != day {
+		usage.Day = day
+		usage.DailyBytes = 0
+		usage.DailyRequests = 0
+	}
+
+	return usage
+}
+
+// exceeded kiểm tra user đã vượt quota chưa (gọi khi đang giữ mu)
+func (q *QuotaManager) exceeded(username string, usage *QuotaUsage) bool {
+	limits, exists := q.limitsFor(username)
+	if !exists {
+		return false
+	}
+
+	return (limits.DailyBytes > 0 && usage.DailyBytes >= limits.DailyBytes) ||
+		(limits.MonthlyBytes > 0 && usage.MonthlyBytes >= limits.MonthlyBytes) ||
+		(limits.DailyRequests > 0 && usage.DailyRequests >= limits.DailyRequests) ||
+		(limits.MonthlyRequests > 0 && usage.MonthlyRequests >= limits.MonthlyRequests)
+}
+
+// BeginRequest ghi nhận một request mới, trả về lỗi nếu user đã hết quota
+func (q *QuotaManager) BeginRequest(username string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := q.currentUsage(username)
+	if q.exceeded(username, usage) {
+		return errQuotaExceeded
+	}
+
+	usage.DailyRequests++
+	usage.MonthlyRequests++
+	q.dirty = true
+	return nil
+}
+
+// AddBytes cộng lưu lượng cho user, trả về false khi quota đã hết
+func (q *QuotaManager) AddBytes(username string, n int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := q.currentUsage(username)
+	usage.DailyBytes += n
+	usage.MonthlyBytes += n
+	q.dirty = true
+
+	limits, exists := q.limitsFor(username)
+	if !exists {
+		return true
+	}
+	return !((limits.DailyBytes > 0 && usage.DailyBytes > limits.DailyBytes) ||
+		(limits.MonthlyBytes > 0 && usage.MonthlyBytes > limits.MonthlyBytes))
+}
+
+// beginQuotaRequest kiểm tra quota của identity trước khi mở kết nối mới
+func beginQuotaRequest(identity *Identity) error {
+	if quotas == nil || identity == nil {
+		return nil
+	}
+	// Giới hạn ghi đè luôn theo lần xác thực mới nhất: callback không còn trả limits
+	// thì user quay về giới hạn trong file quota
+	if identity.Limits != nil {
+		quotas.SetLimits(identity.Username, *identity.Limits)
+	} else {
+		quotas.ClearLimits(identity.Username)
+	}
+	return quotas.BeginRequest(identity.Username)
+}
+
+// meteredConn đếm lưu lượng qua kết nối client và cắt kết nối khi hết quota
+type meteredConn struct {
+	net.Conn
+	username string
+}
+
+// meterConn bọc kết nối client để tính lưu lượng cho identity
+func meterConn(conn net.Conn, identity *Identity) net.Conn {
+	if quotas == nil || identity == nil {
+		return conn
+	}
+	return &meteredConn{Conn: conn, username: identity.Username}
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !quotas.AddBytes(c.username, int64(n)) {
+		logger.Warn("Quota exceeded for user %s, closing connection", c.username)
+		c.Conn.Close()
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 && !quotas.AddBytes(c.username, int64(n)) {
+		logger.Warn("Quota exceeded for user %s, closing connection", c.username)
+		c.Conn.Close()
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestQuotaManager(t *testing.T, limits string) *QuotaManager {
+	t.Helper()
+	dir := t.TempDir()
+	limitsPath := filepath.Join(dir, "quota.json")
+	if limits != "" {
+		if err := os.WriteFile(limitsPath, []byte(limits), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q, err := NewQuotaManager(limitsPath, filepath.Join(dir, "quota_state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestQuotaRequestLimits(t *testing.T) {
+	q := newTestQuotaManager(t, `{"alice": {"daily_requests": 2, "monthly_requests": 3}}`)
+
+	for i := 0; i < 2; i++ {
+		if err := q.BeginRequest("alice"); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if err := q.BeginRequest("alice"); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("got %v, want daily request limit", err)
+	}
+
+	// Sang ngày mới: bộ đếm ngày reset, bộ đếm tháng thì không
+	q.usage["alice"].Day = "2000-01-01"
+	if err := q.BeginRequest("alice"); err != nil {
+		t.Fatalf("after day rollover: %v", err)
+	}
+	q.usage["alice"].Day = "2000-01-01"
+	if err := q.BeginRequest("alice"); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("got %v, want monthly request limit", err)
+	}
+
+	// Sang tháng mới: cả hai bộ đếm reset
+	q.usage["alice"].Month = "2000-01"
+	if err := q.BeginRequest("alice"); err != nil {
+		t.Fatalf("after month rollover: %v", err)
+	}
+	if usage := q.usage["alice"]; usage.DailyRequests != 1 || usage.MonthlyRequests != 1 {
+		t.Fatalf("got usage %+v, want 1 request today and this month", usage)
+	}
+
+	// User không có giới hạn không bị chặn
+	for i := 0; i < 10; i++ {
+		if err := q.BeginRequest("bob"); err != nil {
+			t.Fatalf("unlimited user blocked: %v", err)
+		}
+	}
+}
+
+func TestQuotaByteLimits(t *testing.T) {
+	q := newTestQuotaManager(t, `{"alice": {"daily_bytes": 100, "monthly_bytes": 150}}`)
+
+	if !q.AddBytes("alice", 100) {
+		t.Fatal("usage equal to the limit must be allowed")
+	}
+	if q.AddBytes("alice", 1) {
+		t.Fatal("usage over the daily limit must be rejected")
+	}
+	if err := q.BeginRequest("alice"); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("got %v, want new requests rejected after the byte limit", err)
+	}
+
+	q.usage["alice"].Day = time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	if err := q.BeginRequest("alice"); err != nil {
+		t.Fatalf("after day rollover: %v", err)
+	}
+	if q.AddBytes("alice", 50) {
+		t.Fatal("usage over the monthly limit must be rejected")
+	}
+}
+
+func TestQuotaOverrides(t *testing.T) {
+	q := newTestQuotaManager(t, `{"alice": {"daily_requests": 1}}`)
+
+	q.SetLimits("alice", QuotaLimits{DailyRequests: 3})
+	for i := 0; i < 3; i++ {
+		if err := q.BeginRequest("alice"); err != nil {
+			t.Fatalf("request %d with override: %v", i, err)
+		}
+	}
+
+	q.ClearLimits("alice")
+	if err := q.BeginRequest("alice"); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("got %v, want file limit after clearing the override", err)
+	}
+}
+
+func TestQuotaStatePersists(t *testing.T) {
+	q := newTestQuotaManager(t, `{"alice": {"daily_requests": 2}}`)
+	if err := q.BeginRequest("alice"); err != nil {
+		t.Fatal(err)
+	}
+	q.AddBytes("alice", 42)
+	if err := q.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewQuotaManager(q.limitsPath, q.statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := restored.usage["alice"]
+	if usage == nil || usage.DailyRequests != 1 || usage.DailyBytes != 42 {
+		t.Fatalf("got restored usage %+v", usage)
+	}
+	if err := restored.BeginRequest("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.BeginRequest("alice"); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("got %v, want limit counted across restarts", err)
+	}
+}
+
+func TestMeteredConnClosesOnQuota(t *testing.T) {
+	previous := quotas
+	quotas = newTestQuotaManager(t, `{"alice": {"daily_bytes": 8}}`)
+	defer func() { quotas = previous }()
+
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := meterConn(client, &Identity{Username: "alice"})
+
+	go func() {
+		server.Write([]byte("12345678"))
+		server.Write([]byte("9"))
+	}()
+
+	buf := make([]byte, 8)
+	if n, err := conn.Read(buf); err != nil || n != 8 {
+		t.Fatalf("got %d, %v, want 8 bytes within quota", n, err)
+	}
+	if _, err := conn.Read(buf); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("got %v, want quota exceeded", err)
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Fatal("connection not closed after quota exceeded")
+	}
+	if usage := quotas.usage["alice"]; usage.DailyBytes != 9 {
+		t.Fatalf("got %d metered bytes, want 9", usage.DailyBytes)
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RouteOptions là các tùy chọn chọn upstream client gửi kèm trong username,
+// ví dụ: zpoxy-country-vn-carrier-viettel-session-abc123 hoặc zpoxy-group-premium
+type RouteOptions struct {
+	Country string
+	Carrier string
+	Session string
+	Group   string
+}
+
+// parseUsername tách username gốc và các tùy chọn route từ phần hậu tố
+func parseUsername(username string) (string, RouteOptions, error) {
+	var route RouteOptions
+
+	parts := strings.Split(username, "-")
+	start := len(parts)
+	for i := 1; i < len(parts); i++ {
+		if isRouteKey(parts[i]) {
+			start = i
+			break
+		}
+	}
+
+	base := strings.Join(parts[:start], "-")
+	options := parts[start:]
+	if len(options)%2 != 0 {
+		return "", route, fmt.Errorf("missing value for route option %q", options[len(options)-1])
+	}
+
+	for i := 0; i < len(options); i += 2 {
+		key, value := strings.ToLower(options[i]), options[i+1]
+		if value == "" {
+			return "", route, fmt.Errorf("empty value for route option %q", key)
+		}
+
+		switch key {
+		case "country":
+			route.Country = value
+		case "carrier":
+			route.Carrier = value
+		case "session":
+			route.Session = value
+		case "group":
+			route.Group = value
+		default:
+			return "", route, fmt.Errorf("unknown route option %q", key)
+		}
+	}
+
+	return base, route, nil
+}
+
+func isRouteKey(key string) bool {
+	switch strings.ToLower(key) {
+	case "country", "carrier", "session", "group":
+		return true
+	}
+	return false
+}
+
+// routeValueReplacer bỏ các ký tự phân cách khi so sánh giá trị route
+var routeValueReplacer = strings.NewReplacer(" ", "", "_", "", "-", "")
+
+// normalizeRouteValue chuẩn hóa giá trị để so sánh không phân biệt hoa thường và khoảng trắng
+func normalizeRouteValue(value string) string {
+	return routeValueReplacer.Replace(strings.ToLower(value))
+}
+
+// filter kết hợp selector sẵn có với điều kiện route, giá trị route được chuẩn hóa một lần
+// thay vì mỗi lần xét một proxy
+func (r RouteOptions) filter(selector ProxySelector) ProxySelector {
+	if r.Country != "" {
+		selector = both(selector, SelectLocation(r.Country))
+	}
+	if r.Carrier != "" {
+		selector = both(selector, SelectCarrier(r.Carrier))
+	}
+	return selector
+}
+
+// both trả về selector chỉ nhận proxy qua cả hai bộ lọc
+func both(a, b ProxySelector) ProxySelector {
+	return func(p *Proxy) bool {
+		return a(p) && b(p)
+	}
+}
+
+// allowsProxy kiểm tra proxy thuộc một trong các nhóm upstream được gán cho identity
+func (pm *ProxyManager) allowsProxy(identity *Identity, p *Proxy) bool {
+	if len(identity.Groups) == 0 {
+		return true
+	}
+	for _, group := range identity.Groups {
+		if pm.inGroup(group, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetProxyForRoute chọn proxy theo tùy chọn route của client bằng strategy (nil là strategy mặc định),
+// giữ nguyên upstream cho cùng session. Khi route chỉ định group, chỉ chọn proxy trong group
+// và dùng strategy của group nếu có.
+func (pm *ProxyManager) GetProxyForRoute(identity *Identity, excludeURL string, selector ProxySelector, strategy Strategy) *Proxy {
+	routeSelector := identity.Route.filter(selector)
+	group := identity.Route.Group
+	selector = func(p *Proxy) bool {
+		if group != "" && !pm.inGroup(group, p) {
+			return false
+		}
+		return routeSelector(p) && pm.allowsProxy(identity, p)
+	}
+	if g := pm.Group(group); g != nil && g.strategy != nil {
+		strategy = g.strategy
+	}
+
+	var sessionKey string
+	if identity.Route.Session != "" {
+		sessionKey = identity.Username + "/" + identity.Route.Session
+		if proxy := pm.sessionProxy(sessionKey, excludeURL, selector); proxy != nil {
+			return proxy
+		}
+	}
+
+	proxy := pm.SelectProxy(excludeURL, selector, strategy)
+
+	if proxy != nil && sessionKey != "" {
+		pm.bindSession(sessionKey, proxy)
+	}
+
+	return proxy
+}
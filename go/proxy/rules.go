@@ -0,0 +1,321 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RuleAction là hành động khi một rule khớp với request
+type RuleAction string
+
+const (
+	// RuleActionProxy đi qua upstream như bình thường
+	RuleActionProxy RuleAction = "proxy"
+	// RuleActionGroup chỉ dùng upstream thuộc group
+	RuleActionGroup RuleAction = "group"
+	// RuleActionType chỉ dùng upstream có loại (http/socks5) chỉ định
+	RuleActionType RuleAction = "type"
+	// RuleActionDirect kết nối thẳng tới đích, không qua upstream
+	RuleActionDirect RuleAction = "direct"
+	// RuleActionReject từ chối request
+	RuleActionReject RuleAction = "reject"
+)
+
+// Rule là một luật định tuyến theo đích. Mọi điều kiện được khai báo phải khớp,
+// trong mỗi điều kiện chỉ cần một giá trị khớp; rule không có điều kiện khớp mọi request.
+type Rule struct {
+	Name           string     `json:"name"`
+	Domains        []string   `json:"domain"`
+	DomainSuffixes []string   `json:"domain_suffix"`
+	Regexes        []string   `json:"regex"`
+	CIDRs          []string   `json:"cidr"`
+	Ports          []int      `json:"port"`
+	Users          []string   `json:"user"`
+	Action         RuleAction `json:"action"`
+	Group          string     `json:"group"`
+	Type           ProxyType  `json:"type"`
+
+	regexps  []*regexp.Regexp
+	networks []*net.IPNet
+}
+
+// compile kiểm tra và chuẩn bị regex, CIDR của rule
+func (r *Rule) compile() error {
+	switch r.Action {
+	case RuleActionProxy, RuleActionDirect, RuleActionReject:
+	case RuleActionGroup:
+		if r.Group == "" {
+			return fmt.Errorf("group action requires group")
+		}
+	case RuleActionType:
+		if r.Type != ProxyTypeHTTP && r.Type != ProxyTypeSOCKS5 && r.Type != ProxyTypeSOCKS4 {
+			return fmt.Errorf("type action requires type http, socks4 or socks5")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+
+	for _, pattern := range r.Regexes {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid regex %q: %v", pattern, err)
+		}
+		r.regexps = append(r.regexps, re)
+	}
+
+	for _, value := range r.CIDRs {
+		network, err := parseCIDR(value)
+		if err != nil {
+			return fmt.Errorf("invalid cidr %q: %v", value, err)
+		}
+		r.networks = append(r.networks, network)
+	}
+
+	for i, domain := range r.Domains {
+		r.Domains[i] = strings.ToLower(strings.TrimSuffix(domain, "."))
+	}
+	for i, suffix := range r.DomainSuffixes {
+		r.DomainSuffixes[i] = strings.ToLower(strings.Trim(suffix, "."))
+	}
+	return nil
+}
+
+// matches kiểm tra rule với user, host (tên miền hoặc IP) và port đích
+func (r *Rule) matches(username, host string, port int) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if len(r.Domains) > 0 && !containsString(r.Domains, host) {
+		return false
+	}
+
+	if len(r.DomainSuffixes) > 0 {
+		matched := false
+		for _, suffix := range r.DomainSuffixes {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.regexps) > 0 {
+		matched := false
+		for _, re := range r.regexps {
+			if re.MatchString(host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	// CIDR chỉ so với đích là IP, không phân giải tên miền trên đường xử lý request
+	if len(r.networks) > 0 {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		matched := false
+		for _, network := range r.networks {
+			if network.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Ports) > 0 {
+		matched := false
+		for _, p := range r.Ports {
+			if p == port {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Users) > 0 && !containsString(r.Users, username) {
+		return false
+	}
+
+	return true
+}
+
+// apply áp dụng rule lên request: action group chuyển request sang group của rule
+// (kèm retry và strategy của group), action type thu hẹp bộ lọc proxy
+func (r *Rule) apply(identity *Identity, base ProxySelector) ProxySelector {
+	if r.Action == RuleActionGroup {
+		identity.Route.Group = r.Group
+	}
+	return r.selector(base)
+}
+
+// selector thu hẹp bộ lọc proxy theo loại proxy của rule
+func (r *Rule) selector(base ProxySelector) ProxySelector {
+	switch r.Action {
+	case RuleActionType:
+		return func(p *Proxy) bool {
+			return base(p) && proxyTypeOf(p) == r.Type
+		}
+	default:
+		return base
+	}
+}
+
+// String mô tả rule để ghi log
+func (r *Rule) String() string {
+	name := r.Name
+	if name == "" {
+		name = "unnamed"
+	}
+	switch r.Action {
+	case RuleActionGroup:
+		return fmt.Sprintf("%s (%s %s)", name, r.Action, r.Group)
+	case RuleActionType:
+		return fmt.Sprintf("%s (%s %s)", name, r.Action, r.Type)
+	default:
+		return fmt.Sprintf("%s (%s)", name, r.Action)
+	}
+}
+
+// proxyTypeOf coi proxy chưa xác định loại là proxy HTTP
+func proxyTypeOf(p *Proxy) ProxyType {
+	if p.Type == ProxyTypeUnknown || p.Type == "" {
+		return ProxyTypeHTTP
+	}
+	return p.Type
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleSet là danh sách rule có thứ tự, rule đầu tiên khớp được áp dụng
+type RuleSet struct {
+	path    string
+	mu      sync.RWMutex
+	rules   []*Rule
+	modTime time.Time
+}
+
+var routingRules *RuleSet
+
+// ConfigureRules bật định tuyến theo rule cho tất cả listener
+func ConfigureRules(r *RuleSet) {
+	routingRules = r
+}
+
+// NewRuleSet tạo rule set và tải rule từ file JSON
+func NewRuleSet(path string) (*RuleSet, error) {
+	r := &RuleSet{path: path}
+	if err := r.Load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load đọc file rule, bỏ qua các rule sai cấu hình
+func (r *RuleSet) Load() error {
+	stat, err := os.Stat(r.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat rules file: %v", err)
+	}
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return fmt.Errorf("failed to read rules file: %v", err)
+	}
+
+	var configs []*Rule
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("failed to parse rules file: %v", err)
+	}
+
+	rules := make([]*Rule, 0, len(configs))
+	for i, rule := range configs {
+		if err := rule.compile(); err != nil {
+			logger.Warn("Skipping invalid rule #%d %q: %v", i+1, rule.Name, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	r.mu.Lock()
+	r.rules = rules
+	r.modTime = stat.ModTime()
+	r.mu.Unlock()
+
+	logger.Info("Loaded %d routing rules from %s", len(rules), r.path)
+	return nil
+}
+
+// Watch theo dõi file rule và tải lại khi file thay đổi
+func (r *RuleSet) Watch(interval time.Duration) {
+	r.mu.RLock()
+	modTime := r.modTime
+	r.mu.RUnlock()
+
+	watchFile(r.path, modTime, interval, r.Load)
+}
+
+// Match trả về rule đầu tiên khớp, nil nếu không có rule nào khớp
+func (r *RuleSet) Match(username, host string, port int) *Rule {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, rule := range r.rules {
+		if rule.matches(username, host, port) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// matchRule áp dụng rule set đang cấu hình cho request của identity
+func matchRule(identity *Identity, host string, port int) *Rule {
+	if routingRules == nil {
+		return nil
+	}
+
+	rule := routingRules.Match(identity.Username, host, port)
+	if rule != nil {
+		logger.Info("Request from %s to %s matched rule %s", identity.Username, net.JoinHostPort(host, strconv.Itoa(port)), rule)
+	}
+	return rule
+}
+
+// splitTarget tách host và port của đích, dùng defaultPort nếu không có port
+func splitTarget(target string, defaultPort int) (string, int) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return strings.Trim(target, "[]"), defaultPort
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return host, defaultPort
+	}
+	return host, port
+}
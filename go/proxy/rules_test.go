@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func compiledRule(t *testing.T, rule Rule) *Rule {
+	t.Helper()
+	if rule.Action == "" {
+		rule.Action = RuleActionProxy
+	}
+	if err := rule.compile(); err != nil {
+		t.Fatalf("compile %+v: %v", rule, err)
+	}
+	return &rule
+}
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		user string
+		host string
+		port int
+		want bool
+	}{
+		{"empty rule matches everything", Rule{}, "alice", "example.com", 443, true},
+
+		{"domain exact", Rule{Domains: []string{"example.com"}}, "", "example.com", 443, true},
+		{"domain not subdomain", Rule{Domains: []string{"example.com"}}, "", "www.example.com", 443, false},
+		{"domain case and trailing dot", Rule{Domains: []string{"Example.COM."}}, "", "EXAMPLE.com.", 443, true},
+
+		{"suffix itself", Rule{DomainSuffixes: []string{"example.com"}}, "", "example.com", 80, true},
+		{"suffix subdomain", Rule{DomainSuffixes: []string{".example.com."}}, "", "a.b.Example.com", 80, true},
+		{"suffix label boundary", Rule{DomainSuffixes: []string{"example.com"}}, "", "badexample.com", 80, false},
+		{"suffix any of several", Rule{DomainSuffixes: []string{"vn", "example.com"}}, "", "news.vn", 80, true},
+
+		{"regex", Rule{Regexes: []string{`^api\.[a-z]+\.com$`}}, "", "api.example.com", 443, true},
+		{"regex on lowercased host", Rule{Regexes: []string{`^api\.[a-z]+\.com$`}}, "", "API.Example.com", 443, true},
+		{"regex no match", Rule{Regexes: []string{`^api\.`}}, "", "www.example.com", 443, false},
+
+		{"cidr ipv4", Rule{CIDRs: []string{"10.0.0.0/8"}}, "", "10.1.2.3", 80, true},
+		{"cidr outside", Rule{CIDRs: []string{"10.0.0.0/8"}}, "", "11.1.2.3", 80, false},
+		{"cidr single ip", Rule{CIDRs: []string{"192.168.1.1"}}, "", "192.168.1.1", 80, true},
+		{"cidr ipv6", Rule{CIDRs: []string{"2001:db8::/32"}}, "", "2001:db8::1", 80, true},
+		{"cidr does not resolve domains", Rule{CIDRs: []string{"0.0.0.0/0"}}, "", "example.com", 80, false},
+
+		{"port", Rule{Ports: []int{25, 587}}, "", "smtp.example.com", 587, true},
+		{"port no match", Rule{Ports: []int{25, 587}}, "", "smtp.example.com", 465, false},
+
+		{"user", Rule{Users: []string{"alice", "bob"}}, "bob", "example.com", 443, true},
+		{"user no match", Rule{Users: []string{"alice"}}, "carol", "example.com", 443, false},
+
+		{"all conditions must match", Rule{Users: []string{"alice"}, DomainSuffixes: []string{"example.com"}, Ports: []int{443}}, "alice", "www.example.com", 80, false},
+		{"all conditions match", Rule{Users: []string{"alice"}, DomainSuffixes: []string{"example.com"}, Ports: []int{443}}, "alice", "www.example.com", 443, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := compiledRule(t, test.rule)
+			if got := rule.matches(test.user, test.host, test.port); got != test.want {
+				t.Fatalf("matches(%q, %q, %d) = %v, want %v", test.user, test.host, test.port, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRuleCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"unknown action", Rule{Action: "forward"}},
+		{"group without group", Rule{Action: RuleActionGroup}},
+		{"type without type", Rule{Action: RuleActionType}},
+		{"type unknown", Rule{Action: RuleActionType, Type: "ftp"}},
+		{"invalid regex", Rule{Action: RuleActionProxy, Regexes: []string{"("}}},
+		{"invalid cidr", Rule{Action: RuleActionProxy, CIDRs: []string{"10.0.0.0/33"}}},
+		{"invalid ip", Rule{Action: RuleActionProxy, CIDRs: []string{"example.com"}}},
+	}
+
+	for _, test := range tests {
+		rule := test.rule
+		if err := rule.compile(); err == nil {
+			t.Errorf("%s: expected compile error", test.name)
+		}
+	}
+}
+
+func TestRuleSetMatchFirstRule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+  {"name": "block-ads", "domain_suffix": ["doubleclick.net"], "action": "reject"},
+  {"name": "broken", "regex": ["("], "action": "reject"},
+  {"name": "no-group", "domain": ["example.com"], "action": "group"},
+  {"name": "internal", "cidr": ["10.0.0.0/8"], "action": "direct"},
+  {"name": "mail", "port": [25], "action": "type", "type": "socks5"},
+  {"name": "alice", "user": ["alice"], "action": "group", "group": "premium"},
+  {"name": "catch-all", "action": "proxy"}
+]`
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	set, err := NewRuleSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.rules) != 5 {
+		t.Fatalf("got %d rules, want 5 (invalid rules skipped)", len(set.rules))
+	}
+
+	tests := []struct {
+		user string
+		host string
+		port int
+		want string
+	}{
+		{"alice", "ads.doubleclick.net", 443, "block-ads"},
+		{"alice", "10.0.0.1", 25, "internal"},
+		{"bob", "mail.example.com", 25, "mail"},
+		{"alice", "mail.example.com", 25, "mail"},
+		{"alice", "example.com", 443, "alice"},
+		{"bob", "example.com", 443, "catch-all"},
+	}
+	for _, test := range tests {
+		rule := set.Match(test.user, test.host, test.port)
+		if rule == nil || rule.Name != test.want {
+			t.Errorf("Match(%q, %q, %d) = %v, want %s", test.user, test.host, test.port, rule, test.want)
+		}
+	}
+
+	empty := &RuleSet{}
+	if rule := empty.Match("alice", "example.com", 443); rule != nil {
+		t.Fatalf("empty rule set matched %s", rule)
+	}
+}
+
+func TestSplitTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		host   string
+		port   int
+	}{
+		{"example.com:8443", "example.com", 8443},
+		{"example.com", "example.com", 443},
+		{"[2001:db8::1]:8080", "2001:db8::1", 8080},
+		{"[2001:db8::1]", "2001:db8::1", 443},
+		{"example.com:https", "example.com", 443},
+	}
+	for _, test := range tests {
+		host, port := splitTarget(test.target, 443)
+		if host != test.host || port != test.port {
+			t.Errorf("splitTarget(%q) = %q, %d, want %q, %d", test.target, host, port, test.host, test.port)
+		}
+	}
+}
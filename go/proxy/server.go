@@ -36,6 +36,9 @@ func (t *ProxyTransport) RoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*h
 	logger.Request("Host: %s", req.Host)
 	logger.Header("Headers:")
 	for k, v := range req.Header {
+		if isSensitiveHeader(k) {
+			v = []string{"[redacted]"}
+		}
 		logger.Header("  %s: %v", k, v)
 	}
 
@@ -56,7 +59,7 @@ func (t *ProxyTransport) RoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*h
 				excludeURL = lastProxy.URL
 			}
 			proxy = t.proxyManager.GetNextWorkingProxy(excludeURL)
-			logger.Info("Retry %d/%d with proxy %s", retry, t.proxyManager.maxRetries, proxy.URL)
+			logger.Info("Retry %d/%d with proxy %s", retry, t.proxyManager.maxRetries, proxy.Redacted())
 		}
 
 		if proxy == nil {
@@ -80,7 +83,7 @@ func (t *ProxyTransport) RoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*h
 		var err error
 
 		// Parse proxy URL based on format
-		if strings.Contains(proxy.URL, "http://") {
+		if strings.Contains(proxy.URL, "://") {
 			// URL already has scheme
 			proxyURL, err = url.Parse(proxy.URL)
 		} else {
@@ -89,7 +92,7 @@ func (t *ProxyTransport) RoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*h
 		}
 
 		if err != nil {
-			logger.Error("Invalid proxy URL: %v", err)
+			logger.Error("Invalid proxy URL %s: %v", proxy.Redacted(), urlParseError(err))
 			lastError = err
 			t.proxyManager.MarkProxyFailed(proxy)
 			continue // Try next proxy
@@ -148,7 +151,7 @@ func (t *ProxyTransport) RoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*h
 				Timeout:   clientTimeout,
 			}
 
-			logger.Proxy("Forwarding HTTP request to: %s via proxy %s", forwardReq.URL.String(), proxyURL.String())
+			logger.Proxy("Forwarding HTTP request to: %s via proxy %s", forwardReq.URL.String(), proxyURL.Redacted())
 			resp, err := client.Do(forwardReq)
 			if err != nil {
 				logger.Error("Error forwarding HTTP request: %v", err)
@@ -161,7 +164,7 @@ func (t *ProxyTransport) RoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*h
 			return resp, nil
 		}
 
-		logger.Proxy("Forwarding request to: %s via proxy %s", forwardReq.URL.String(), proxyURL.String())
+		logger.Proxy("Forwarding request to: %s via proxy %s", forwardReq.URL.String(), proxyURL.Redacted())
 
 		// Set custom timeout for the request context
 		ctx, cancel := context.WithTimeout(forwardReq.Context(), clientTimeout)
@@ -222,7 +225,7 @@ func (t *ProxyTransport) handleConnect(host string, ctx *goproxy.ProxyCtx) (*gop
 		return goproxy.RejectConnect, "no proxy available"
 	}
 
-	logger.Proxy("Using proxy: %s", proxy.URL)
+	logger.Proxy("Using proxy: %s", proxy.Describe())
 	logger.EndRequest()
 	return goproxy.OkConnect, host
 }
@@ -248,8 +251,47 @@ func NewProxyServer(proxyManager *ProxyManager) http.Handler {
 	return proxy
 }
 
-// StartProxyServer khởi động proxy server lắng nghe kết nối
+// ListenerConfig là một địa chỉ lắng nghe kèm strategy chọn upstream riêng (nil là mặc định)
+type ListenerConfig struct {
+	Addr     string
+	Strategy Strategy
+}
+
+// ParseListeners đọc danh sách listener dạng ":8081,:8083=least-latency"
+func ParseListeners(value string) ([]ListenerConfig, error) {
+	var listeners []ListenerConfig
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		addr, strategyName, hasStrategy := strings.Cut(part, "=")
+		listener := ListenerConfig{Addr: addr}
+		if hasStrategy {
+			strategy, err := NewStrategy(strategyName)
+			if err != nil {
+				return nil, fmt.Errorf("invalid listener %q: %v", part, err)
+			}
+			listener.Strategy = strategy
+		}
+		listeners = append(listeners, listener)
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listeners configured")
+	}
+	return listeners, nil
+}
+
+// StartProxyServer khởi động proxy server lắng nghe kết nối, dùng strategy mặc định của ProxyManager
 func StartProxyServer(pm *ProxyManager, addr string) error {
+	return StartProxyListener(pm, addr, nil)
+}
+
+// StartProxyListener khởi động proxy server tại addr, chọn upstream bằng strategy riêng của listener
+// (nil là strategy mặc định của ProxyManager)
+func StartProxyListener(pm *ProxyManager, addr string, strategy Strategy) error {
 	// Cấu hình SOCKS5
 	ConfigureSOCKS5(&SOCKS5Config{
 		SkipVerify: true, // Bỏ qua xác thực SSL
@@ -260,7 +302,11 @@ func StartProxyServer(pm *ProxyManager, addr string) error {
 		return fmt.Errorf("failed to listen on %s: %v", addr, err)
 	}
 
-	logger.Info("Starting proxy server on %s", addr)
+	strategyName := "default"
+	if strategy != nil {
+		strategyName = strategy.Name()
+	}
+	logger.Info("Starting proxy server on %s (strategy: %s)", addr, strategyName)
 
 	for {
 		conn, err := listener.Accept()
@@ -269,12 +315,12 @@ func StartProxyServer(pm *ProxyManager, addr string) error {
 			continue
 		}
 
-		go handleProxyConnection(conn, pm)
+		go handleProxyConnection(conn, pm, strategy)
 	}
 }
 
 // handleProxyConnection xử lý kết nối mới
-func handleProxyConnection(clientConn net.Conn, pm *ProxyManager) {
+func handleProxyConnection(clientConn net.Conn, pm *ProxyManager, strategy Strategy) {
 	defer clientConn.Close()
 
 	// Đọc byte đầu tiên để xác định protocol
@@ -295,7 +341,7 @@ func handleProxyConnection(clientConn net.Conn, pm *ProxyManager) {
 			Conn:   clientConn,
 		}
 
-		handleSOCKS5(readerConn, pm)
+		handleSOCKS5(readerConn, pm, strategy)
 		return
 	}
 
@@ -309,9 +355,9 @@ func handleProxyConnection(clientConn net.Conn, pm *ProxyManager) {
 
 	// Xác định nếu là CONNECT (HTTPS) hoặc HTTP thông thường
 	if strings.HasPrefix(firstLine, "CONNECT") {
-		handleHTTPSProxy(clientConn, reader, firstLine, pm)
+		handleHTTPSProxy(clientConn, reader, firstLine, pm, strategy)
 	} else {
-		handleHTTPProxy(clientConn, reader, firstLine, pm)
+		handleHTTPProxy(clientConn, reader, firstLine, pm, strategy)
 	}
 }
 
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sessionHeader là header client dùng để chỉ định sticky session thay cho hậu tố username
+const sessionHeader = "X-Proxy-Session"
+
+// maxSessionLength giới hạn độ dài session client gửi lên
+const maxSessionLength = 128
+
+// stickySession gắn một session của client với một upstream cho tới khi hết TTL
+type stickySession struct {
+	proxyURL  string
+	keyID     string
+	createdAt time.Time
+	expiresAt time.Time
+}
+
+// SetSessionOptions đặt thời gian giữ sticky session (gia hạn mỗi lần dùng) và bật session theo IP client
+func (pm *ProxyManager) SetSessionOptions(ttl time.Duration, byClientIP bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.sessionTTL = ttl
+	pm.sessionByIP = byClientIP
+}
+
+// resolveSession xác định session của request: hậu tố username, sau đó header X-Proxy-Session,
+// cuối cùng là IP client nếu được bật
+func (pm *ProxyManager) resolveSession(identity *Identity, headerValue string, clientIP net.IP) {
+	if identity.Route.Session != "" {
+		return
+	}
+
+	if headerValue = strings.TrimSpace(headerValue); headerValue != "" {
+		if len(headerValue) > maxSessionLength {
+			headerValue = headerValue[:maxSessionLength]
+		}
+		identity.Route.Session = headerValue
+		return
+	}
+
+	pm.mu.RLock()
+	byIP := pm.sessionByIP
+	pm.mu.RUnlock()
+	if byIP && clientIP != nil {
+		identity.Route.Session = "ip:" + clientIP.String()
+	}
+}
+
+// headerValue tìm header không phân biệt hoa thường
+func headerValue(headers map[string]string, name string) string {
+	if value, ok := headers[name]; ok {
+		return value
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// sessionProxy trả về proxy đang gắn với session nếu chưa hết hạn và chưa bị đánh dấu lỗi.
+// Nếu request cần loại proxy khác (HTTP/SOCKS5), proxy cùng key được dùng để giữ nguyên IP ra.
+func (pm *ProxyManager) sessionProxy(sessionKey, excludeURL string, selector ProxySelector) *Proxy {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	pm.sessionsMu.Lock()
+	defer pm.sessionsMu.Unlock()
+
+	session, exists := pm.sessions[sessionKey]
+	if !exists {
+		return nil
+	}
+
+	now := time.Now()
+	if now.After(session.expiresAt) {
+		delete(pm.sessions, sessionKey)
+		return nil
+	}
+	if session.proxyURL == excludeURL {
+		return nil
+	}
+
+	accept := func(p *Proxy) bool {
+		return p != nil && p.URL != excludeURL && pm.usable(p, now) && selector(p) && p.reserveTrial(now.UnixNano())
+	}
+
+	proxy := pm.byURL[session.proxyURL]
+	if !accept(proxy) {
+		proxy = nil
+		if session.keyID != "" {
+			for _, proxyType := range []ProxyType{ProxyTypeHTTP, ProxyTypeSOCKS5, ProxyTypeSOCKS4} {
+				if candidate := pm.byID[session.keyID+"/"+string(proxyType)]; accept(candidate) {
+					proxy = candidate
+					break
+				}
+			}
+		}
+	}
+
+	if proxy != nil {
+		session.expiresAt = now.Add(pm.sessionTTL)
+	}
+	return proxy
+}
+
+// bindSession gắn session với proxy vừa được chọn
+func (pm *ProxyManager) bindSession(sessionKey string, proxy *Proxy) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	pm.sessionsMu.Lock()
+	defer pm.sessionsMu.Unlock()
+
+	now := time.Now()
+	pm.pruneSessions(now)
+
+	if session, exists := pm.sessions[sessionKey]; exists && session.proxyURL != proxy.URL {
+		logger.Info("Session %s failed over to %s", sessionKey, proxy.Describe())
+	}
+
+	pm.sessions[sessionKey] = &stickySession{
+		proxyURL:  proxy.URL,
+		keyID:     proxy.KeyID,
+		createdAt: now,
+		expiresAt: now.Add(pm.sessionTTL),
+	}
+}
+
+// pruneSessions xóa các session đã hết hạn, tối đa mỗi phút một lần (gọi khi đang giữ sessionsMu)
+func (pm *ProxyManager) pruneSessions(now time.Time) {
+	if now.Sub(pm.lastPrune) < time.Minute {
+		return
+	}
+	pm.lastPrune = now
+
+	for key, session := range pm.sessions {
+		if now.After(session.expiresAt) {
+			delete(pm.sessions, key)
+		}
+	}
+}
+
+// SessionInfo là một sticky session đang hoạt động
+type SessionInfo struct {
+	Session   string    `json:"session"`
+	Proxy     string    `json:"proxy"`
+	KeyID     string    `json:"key_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Sessions trả về các sticky session chưa hết hạn, xóa các session đã hết hạn
+func (pm *ProxyManager) Sessions() []SessionInfo {
+	pm.sessionsMu.Lock()
+	defer pm.sessionsMu.Unlock()
+
+	now := time.Now()
+	pm.lastPrune = time.Time{}
+	pm.pruneSessions(now)
+
+	sessions := make([]SessionInfo, 0, len(pm.sessions))
+	for key, session := range pm.sessions {
+		info := SessionInfo{
+			Session:   key,
+			Proxy:     redactURL(session.proxyURL),
+			CreatedAt: session.createdAt,
+			ExpiresAt: session.expiresAt,
+		}
+		if session.keyID != "" {
+			info.KeyID = maskKey(session.keyID)
+		}
+		sessions = append(sessions, info)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Session < sessions[j].Session
+	})
+	return sessions
+}
@@ -7,37 +7,54 @@ import (
 )
 
 // SOCKS5Auth xử lý xác thực SOCKS5
-func SOCKS5Auth(clientConn net.Conn) (bool, error) {
+func SOCKS5Auth(clientConn net.Conn) (*Identity, error) {
 	// Đọc phiên bản SOCKS và số phương thức xác thực
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(clientConn, header); err != nil {
-		return false, fmt.Errorf("failed to read SOCKS5 header: %v", err)
+		return nil, fmt.Errorf("failed to read SOCKS5 header: %v", err)
 	}
 
 	if header[0] != SOCKS5_VERSION {
-		return false, fmt.Errorf("unsupported SOCKS version: %d", header[0])
+		return nil, fmt.Errorf("unsupported SOCKS version: %d", header[0])
 	}
 
 	// Đọc danh sách phương thức xác thực được hỗ trợ
 	methodCount := int(header[1])
 	methods := make([]byte, methodCount)
 	if _, err := io.ReadFull(clientConn, methods); err != nil {
-		return false, fmt.Errorf("failed to read authentication methods: %v", err)
+		return nil, fmt.Errorf("failed to read authentication methods: %v", err)
 	}
 
-	// Kiểm tra xem có phương thức xác thực username/password không
+	// Kiểm tra các phương thức client hỗ trợ
+	hasNoAuth := false
 	hasUserPass := false
 	for _, method := range methods {
-		if method == 0x02 {
+		switch method {
+		case 0x00:
+			hasNoAuth = true
+		case 0x02:
 			hasUserPass = true
-			break
 		}
 	}
 
+	// Client có IP trong allowlist được dùng phương thức "no auth"
+	clientIP := remoteIP(clientConn)
+	if hasNoAuth {
+		if identity := allowlistIdentity(clientIP); identity != nil {
+			clientConn.Write([]byte{SOCKS5_VERSION, 0x00})
+			return identity, nil
+		}
+	}
+
+	if authMode == AuthModeIP {
+		clientConn.Write([]byte{SOCKS5_VERSION, 0xFF})
+		return nil, fmt.Errorf("client IP %s is not allowlisted", clientIP)
+	}
+
 	if !hasUserPass {
 		// Nếu không có phương thức xác thực username/password, trả về lỗi
 		clientConn.Write([]byte{SOCKS5_VERSION, 0xFF})
-		return false, fmt.Errorf("username/password authentication not supported")
+		return nil, fmt.Errorf("username/password authentication not supported")
 	}
 
 	// Gửi thông báo chọn phương thức xác thực username/password
@@ -46,45 +63,51 @@ func SOCKS5Auth(clientConn net.Conn) (bool, error) {
 	// Đọc thông tin xác thực
 	authHeader := make([]byte, 1)
 	if _, err := io.ReadFull(clientConn, authHeader); err != nil {
-		return false, fmt.Errorf("failed to read auth header: %v", err)
+		return nil, fmt.Errorf("failed to read auth header: %v", err)
 	}
 
 	if authHeader[0] != 0x01 {
-		return false, fmt.Errorf("unsupported auth version: %d", authHeader[0])
+		return nil, fmt.Errorf("unsupported auth version: %d", authHeader[0])
 	}
 
 	// Đọc độ dài username
 	usernameLen := make([]byte, 1)
 	if _, err := io.ReadFull(clientConn, usernameLen); err != nil {
-		return false, fmt.Errorf("failed to read username length: %v", err)
+		return nil, fmt.Errorf("failed to read username length: %v", err)
 	}
 
 	// Đọc username
 	username := make([]byte, usernameLen[0])
 	if _, err := io.ReadFull(clientConn, username); err != nil {
-		return false, fmt.Errorf("failed to read username: %v", err)
+		return nil, fmt.Errorf("failed to read username: %v", err)
 	}
 
 	// Đọc độ dài password
 	passwordLen := make([]byte, 1)
 	if _, err := io.ReadFull(clientConn, passwordLen); err != nil {
-		return false, fmt.Errorf("failed to read password length: %v", err)
+		return nil, fmt.Errorf("failed to read password length: %v", err)
 	}
 
 	// Đọc password
 	password := make([]byte, passwordLen[0])
 	if _, err := io.ReadFull(clientConn, password); err != nil {
-		return false, fmt.Errorf("failed to read password: %v", err)
+		return nil, fmt.Errorf("failed to read password: %v", err)
 	}
 
-	// Kiểm tra thông tin xác thực
-	if string(username) != "zpoxy" || string(password) != "manhdz" {
+	// Kiểm tra thông tin xác thực (SOCKS5 xác thực trước khi client gửi địa chỉ đích)
+	identity, err := authenticate(&AuthRequest{
+		Username: string(username),
+		Password: string(password),
+		Protocol: "socks5",
+		ClientIP: ipString(clientIP),
+	})
+	if err != nil {
 		// Gửi thông báo xác thực thất bại
 		clientConn.Write([]byte{0x01, 0x01})
-		return false, fmt.Errorf("invalid credentials")
+		return nil, err
 	}
 
 	// Gửi thông báo xác thực thành công
 	clientConn.Write([]byte{0x01, 0x00})
-	return true, nil
+	return identity, nil
 }
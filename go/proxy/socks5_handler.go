@@ -2,11 +2,9 @@ package proxy
 
 import (
 	"encoding/binary"
-	"fmt"
 	"io"
 	"net"
-	"net/url"
-	"strings"
+	"strconv"
 	"time"
 )
 
@@ -41,15 +39,18 @@ func ConfigureSOCKS5(config *SOCKS5Config) {
 }
 
 // Xử lý request SOCKS5
-func handleSOCKS5(clientConn net.Conn, pm *ProxyManager) {
+func handleSOCKS5(clientConn net.Conn, pm *ProxyManager, strategy Strategy) {
 	logger.Info("Handling SOCKS5 proxy request")
 	defer clientConn.Close()
 
 	// Xác thực SOCKS5
-	if ok, err := SOCKS5Auth(clientConn); !ok {
+	identity, err := SOCKS5Auth(clientConn)
+	if err != nil {
 		logger.Error("SOCKS5 authentication failed: %v", err)
 		return
 	}
+	logger.Info("Authenticated SOCKS5 user %s", identity.Username)
+	pm.resolveSession(identity, "", remoteIP(clientConn))
 
 	// Đọc request
 	header := make([]byte, 4)
@@ -131,203 +132,84 @@ func handleSOCKS5(clientConn net.Conn, pm *ProxyManager) {
 	}
 	targetPort = binary.BigEndian.Uint16(portBytes)
 
-	targetAddr := fmt.Sprintf("%s:%d", targetHost, targetPort)
+	targetAddr := net.JoinHostPort(targetHost, strconv.Itoa(int(targetPort)))
 	logger.Info("SOCKS5 target: %s", targetAddr)
 
-	// Lấy proxy SOCKS5 mới từ API
-	proxy, err := GetProxyForRequest(ProxyTypeSOCKS5)
-	if err != nil {
-		logger.Error("Failed to get SOCKS5 proxy: %v", err)
-		sendSocks5Error(clientConn, 0x01)
-		return
-	}
-
-	// Mở kết nối tới proxy SOCKS5
-	logger.Info("Using SOCKS5 proxy: %s", proxy.URL)
-
-	proxyURL, err := url.Parse(proxy.URL)
-	if err != nil {
-		logger.Error("Failed to parse proxy URL: %v", err)
-		sendSocks5Error(clientConn, 0x01)
-		return
-	}
-
-	proxyHost := proxyURL.Host
-	if proxyHost == "" {
-		proxyHost = proxy.URL
-	}
-
-	// Lấy IP của proxy
-	proxyIP := strings.Split(proxyHost, ":")[0]
-	proxyPort := strings.Split(proxyHost, ":")[1]
-
-	logger.Info("Connecting to SOCKS5 proxy at %s", proxyHost)
-
-	proxyConn, err := net.DialTimeout("tcp", proxyHost, 10*time.Second)
-	if err != nil {
-		logger.Error("Failed to connect to SOCKS5 proxy: %v", err)
-		sendSocks5Error(clientConn, 0x01)
-		return
-	}
-	defer proxyConn.Close()
-
-	// Thực hiện bắt tay SOCKS5 với proxy
-	var authMethods []byte
-	if proxy.Username != "" && proxy.Password != "" {
-		authMethods = []byte{0x00, 0x02}
-	} else {
-		authMethods = []byte{0x00}
-	}
-
-	auth := []byte{SOCKS5_VERSION, byte(len(authMethods))}
-	auth = append(auth, authMethods...)
-	if _, err := proxyConn.Write(auth); err != nil {
-		logger.Error("Failed to send auth methods to proxy: %v", err)
-		sendSocks5Error(clientConn, 0x01)
-		return
-	}
-
-	authResp := make([]byte, 2)
-	if _, err := io.ReadFull(proxyConn, authResp); err != nil {
-		logger.Error("Failed to read auth response from proxy: %v", err)
-		sendSocks5Error(clientConn, 0x01)
+	// Kiểm tra quota của user
+	if err := beginQuotaRequest(identity); err != nil {
+		logger.Error("Rejecting SOCKS5 request from user %s: %v", identity.Username, err)
+		sendSocks5Error(clientConn, 0x02)
 		return
 	}
 
-	if authResp[0] != SOCKS5_VERSION {
-		logger.Error("Invalid SOCKS version in auth response: %v", authResp)
-		sendSocks5Error(clientConn, 0x01)
-		return
+	socks5Selector := func(p *Proxy) bool {
+		return p.Type == ProxyTypeSOCKS5 || p.Type == ProxyTypeSOCKS4
 	}
 
-	if authResp[1] == 0x02 && proxy.Username != "" && proxy.Password != "" {
-		logger.Info("Proxy requires username/password authentication")
-
-		authReq := []byte{0x01}
-		authReq = append(authReq, byte(len(proxy.Username)))
-		authReq = append(authReq, []byte(proxy.Username)...)
-		authReq = append(authReq, byte(len(proxy.Password)))
-		authReq = append(authReq, []byte(proxy.Password)...)
-
-		if _, err := proxyConn.Write(authReq); err != nil {
-			logger.Error("Failed to send authentication to proxy: %v", err)
-			sendSocks5Error(clientConn, 0x01)
+	// Áp dụng rule định tuyến theo đích
+	if rule := matchRule(identity, targetHost, int(targetPort)); rule != nil {
+		switch {
+		case rule.Action == RuleActionReject:
+			sendSocks5Error(clientConn, 0x02)
 			return
-		}
-
-		authStatusResp := make([]byte, 2)
-		if _, err := io.ReadFull(proxyConn, authStatusResp); err != nil {
-			logger.Error("Failed to read auth status from proxy: %v", err)
-			sendSocks5Error(clientConn, 0x01)
+		case rule.Action == RuleActionDirect:
+			upstream, err := net.DialTimeout("tcp", targetAddr, 10*time.Second)
+			if err != nil {
+				logger.Error("Failed to connect directly to %s: %v", targetAddr, err)
+				sendSocks5Error(clientConn, 0x05)
+				return
+			}
+			defer upstream.Close()
+			if _, err := clientConn.Write(socks5BoundReply(upstream.LocalAddr())); err != nil {
+				logger.Error("Failed to send success response to client: %v", err)
+				return
+			}
+			logger.Info("SOCKS5 connection established directly to %s", targetAddr)
+			handleTLSOverSOCKS5(meterConn(clientConn, identity), targetAddr, upstream)
 			return
-		}
-
-		if authStatusResp[0] != 0x01 || authStatusResp[1] != 0x00 {
-			logger.Error("Authentication failed: %v", authStatusResp)
-			sendSocks5Error(clientConn, 0x01)
+		case rule.Action == RuleActionType && rule.Type == ProxyTypeHTTP:
+			upstream, proxy, err := pm.dialTunnel(identity, rule.selector(func(*Proxy) bool { return true }), strategy, targetHost, int(targetPort))
+			if err != nil {
+				logger.Error("Failed to reach %s via HTTP upstream: %v", targetAddr, err)
+				sendSocks5Error(clientConn, 0x01)
+				return
+			}
+			defer upstream.Close()
+			defer pm.TrackConnection(proxy)()
+			upstream, finishTransfer := pm.TrackTransfer(proxy, upstream)
+			defer finishTransfer()
+			if _, err := clientConn.Write(socks5BoundReply(upstream.RemoteAddr())); err != nil {
+				logger.Error("Failed to send success response to client: %v", err)
+				return
+			}
+			logger.Info("SOCKS5 connection established to %s via HTTP proxy %s", targetAddr, proxy.Describe())
+			handleTLSOverSOCKS5(meterConn(clientConn, identity), targetAddr, upstream)
 			return
+		default:
+			socks5Selector = rule.apply(identity, socks5Selector)
 		}
-
-		logger.Info("Authentication successful")
-	} else if authResp[1] != 0x00 {
-		logger.Error("Proxy did not accept authentication method: %v", authResp[1])
-		sendSocks5Error(clientConn, 0x01)
-		return
 	}
 
-	// Gửi request kết nối
-	request := make([]byte, 0, 10+len(targetHost))
-	request = append(request, SOCKS5_VERSION, SOCKS5_CMD_CONNECT, 0x00)
-
-	switch addrType {
-	case SOCKS5_ADDR_TYPE_IPV4:
-		request = append(request, SOCKS5_ADDR_TYPE_IPV4)
-		ip := net.ParseIP(targetHost).To4()
-		request = append(request, ip...)
-
-	case SOCKS5_ADDR_TYPE_DOMAIN:
-		request = append(request, SOCKS5_ADDR_TYPE_DOMAIN)
-		request = append(request, byte(len(targetHost)))
-		request = append(request, []byte(targetHost)...)
-
-	case SOCKS5_ADDR_TYPE_IPV6:
-		request = append(request, SOCKS5_ADDR_TYPE_IPV6)
-		ip := net.ParseIP(targetHost).To16()
-		request = append(request, ip...)
-	}
-
-	request = append(request, byte(targetPort>>8), byte(targetPort))
-
-	if _, err := proxyConn.Write(request); err != nil {
-		logger.Error("Failed to send connection request to proxy: %v", err)
-		sendSocks5Error(clientConn, 0x01)
-		return
-	}
-
-	reply := make([]byte, 4)
-	if _, err := io.ReadFull(proxyConn, reply); err != nil {
-		logger.Error("Failed to read connection response from proxy: %v", err)
-		sendSocks5Error(clientConn, 0x01)
-		return
-	}
-
-	if reply[0] != SOCKS5_VERSION {
-		logger.Error("Invalid SOCKS version in response: %d", reply[0])
+	// Mở tunnel qua proxy SOCKS4/SOCKS5 phù hợp với tùy chọn route của client, thử upstream khác khi lỗi
+	upstream, proxy, err := pm.dialTunnel(identity, socks5Selector, strategy, targetHost, int(targetPort))
+	if err != nil {
+		logger.Error("Failed to reach %s via SOCKS upstream: %v", targetAddr, err)
 		sendSocks5Error(clientConn, 0x01)
 		return
 	}
+	defer upstream.Close()
+	defer pm.TrackConnection(proxy)()
+	upstream, finishTransfer := pm.TrackTransfer(proxy, upstream)
+	defer finishTransfer()
 
-	if reply[1] != 0x00 {
-		logger.Error("Proxy connection failed: %d", reply[1])
-		sendSocks5Error(clientConn, reply[1])
-		return
-	}
-
-	switch reply[3] {
-	case SOCKS5_ADDR_TYPE_IPV4:
-		skipBytes := make([]byte, 4+2)
-		io.ReadFull(proxyConn, skipBytes)
-
-	case SOCKS5_ADDR_TYPE_DOMAIN:
-		lenByte := make([]byte, 1)
-		io.ReadFull(proxyConn, lenByte)
-		skipBytes := make([]byte, int(lenByte[0])+2)
-		io.ReadFull(proxyConn, skipBytes)
-
-	case SOCKS5_ADDR_TYPE_IPV6:
-		skipBytes := make([]byte, 16+2)
-		io.ReadFull(proxyConn, skipBytes)
-	}
-
-	// Trả về IP của proxy thay vì IP local
-	successReply := []byte{
-		SOCKS5_VERSION,
-		0x00,
-		0x00,
-		SOCKS5_ADDR_TYPE_IPV4,
-	}
-
-	// Thêm IP của proxy vào response
-	ip := net.ParseIP(proxyIP).To4()
-	successReply = append(successReply, ip...)
-
-	// Thêm port của proxy vào response
-	port, _ := fmt.Sscanf(proxyPort, "%d", &targetPort)
-	if port == 1 {
-		successReply = append(successReply, byte(targetPort>>8), byte(targetPort))
-	} else {
-		successReply = append(successReply, 0, 0)
-	}
-
-	if _, err := clientConn.Write(successReply); err != nil {
+	// Trả về địa chỉ đã phân giải của proxy (IPv4 hoặc IPv6) thay vì IP local
+	if _, err := clientConn.Write(socks5BoundReply(upstream.RemoteAddr())); err != nil {
 		logger.Error("Failed to send success response to client: %v", err)
 		return
 	}
 
-	logger.Info("SOCKS5 connection established to %s via %s", targetAddr, proxy.URL)
-
-	// Tạo tunnel giữa client và target
-	handleTLSOverSOCKS5(clientConn, targetAddr, proxyConn)
+	logger.Info("SOCKS5 connection established to %s via %s", targetAddr, proxy.Describe())
+	handleTLSOverSOCKS5(meterConn(clientConn, identity), targetAddr, upstream)
 }
 
 // handleTLSOverSOCKS5 xử lý kết nối TLS qua SOCKS5
@@ -371,3 +253,22 @@ func sendSocks5Error(conn net.Conn, errorCode byte) {
 
 	conn.Write(errorReply)
 }
+
+// socks5BoundReply tạo reply thành công với BND.ADDR/BND.PORT là addr, dùng IPv4 nếu có thể
+func socks5BoundReply(addr net.Addr) []byte {
+	reply := []byte{SOCKS5_VERSION, 0x00, 0x00}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return append(reply, SOCKS5_ADDR_TYPE_IPV4, 0, 0, 0, 0, 0, 0)
+	}
+
+	if ip := tcpAddr.IP.To4(); ip != nil {
+		reply = append(reply, SOCKS5_ADDR_TYPE_IPV4)
+		reply = append(reply, ip...)
+	} else {
+		reply = append(reply, SOCKS5_ADDR_TYPE_IPV6)
+		reply = append(reply, tcpAddr.IP.To16()...)
+	}
+	return append(reply, byte(tcpAddr.Port>>8), byte(tcpAddr.Port))
+}
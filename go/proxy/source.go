@@ -0,0 +1,440 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// UpstreamSource là một nguồn cung cấp danh sách upstream proxy
+type UpstreamSource interface {
+	Name() string
+	Fetch() ([]*Proxy, error)
+}
+
+// SnapshotSource là nguồn luôn trả về toàn bộ danh sách proxy của nó: ProxyManager đối chiếu
+// pool với danh sách này (thêm mới, cập nhật, gỡ proxy không còn trong danh sách) thay vì chỉ thêm mới
+type SnapshotSource interface {
+	UpstreamSource
+	Snapshot() bool
+}
+
+// SourceOptions cấu hình cách ProxyManager làm mới và gắn nhãn proxy của một nguồn
+type SourceOptions struct {
+	Interval time.Duration
+	Priority int
+	Weight   int
+	Tag      string
+	// Groups là các group upstream mà proxy của nguồn thuộc về
+	Groups []string
+	// TTL gỡ proxy khỏi pool khi nguồn không trả về nó trong khoảng này, 0 là giữ mãi
+	TTL time.Duration
+}
+
+// defaultAPITTL là TTL mặc định của nguồn api: endpoint random chỉ trả một key mỗi lần
+// nên pool không biết key nào đã bị xóa nếu không có TTL
+const defaultAPITTL = time.Hour
+
+// minRefreshInterval giới hạn tần suất làm mới một nguồn khi có tín hiệu refresh
+const minRefreshInterval = time.Second
+
+type sourceEntry struct {
+	source      UpstreamSource
+	options     SourceOptions
+	refresh     chan struct{}
+	lastRefresh time.Time
+	breaker     *CircuitBreaker
+}
+
+// AddSource đăng ký một nguồn upstream với ProxyManager
+func (pm *ProxyManager) AddSource(source UpstreamSource, options SourceOptions) {
+	if options.Interval <= 0 {
+		options.Interval = 5 * time.Minute
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.sources = append(pm.sources, &sourceEntry{
+		source:  source,
+		options: options,
+		refresh: make(chan struct{}, 1),
+		breaker: NewCircuitBreaker(sourceHealthConfig.FailureThreshold, sourceHealthConfig.BaseBackoff, sourceHealthConfig.MaxBackoff),
+	})
+}
+
+// RequestRefresh báo cho các nguồn làm mới pool sớm hơn lịch định kỳ, không chờ kết quả
+func (pm *ProxyManager) RequestRefresh() {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	for _, entry := range pm.sources {
+		select {
+		case entry.refresh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// StartSources làm mới tất cả các nguồn ngay lập tức rồi định kỳ theo interval riêng
+func (pm *ProxyManager) StartSources() {
+	pm.mu.RLock()
+	sources := make([]*sourceEntry, len(pm.sources))
+	copy(sources, pm.sources)
+	pm.mu.RUnlock()
+
+	for _, entry := range sources {
+		pm.refreshSource(entry)
+
+		go func(entry *sourceEntry) {
+			ticker := time.NewTicker(entry.options.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-entry.refresh:
+					if time.Since(entry.lastRefresh) < minRefreshInterval {
+						continue
+					}
+				}
+				pm.refreshSource(entry)
+			}
+		}(entry)
+	}
+
+	go pm.watchTTL(ttlCheckInterval)
+}
+
+// refreshSource lấy proxy từ một nguồn và gộp vào pool
+func (pm *ProxyManager) refreshSource(entry *sourceEntry) {
+	entry.lastRefresh = time.Now()
+
+	// Breaker đang mở thì không gọi nguồn, tiếp tục phục vụ proxy đã có
+	if err := entry.breaker.Allow(); err != nil {
+		pm.updateSourceExpiry(entry)
+		return
+	}
+
+	proxies, err := entry.source.Fetch()
+	if err != nil {
+		logger.Error("Failed to fetch proxies from source %s: %v", entry.source.Name(), err)
+		if entry.breaker.Failure(err) {
+			logger.Warn("Circuit breaker opened for source %s until %s", entry.source.Name(), entry.breaker.Status().RetryAt.Format(time.RFC3339))
+		}
+		pm.updateSourceExpiry(entry)
+		return
+	}
+	entry.breaker.Success()
+	pm.updateSourceExpiry(entry)
+
+	for _, p := range proxies {
+		p.Source = entry.source.Name()
+		p.Priority = entry.options.Priority
+		if p.Weight == 0 && entry.options.Weight > 0 {
+			p.Weight = entry.options.Weight
+		}
+		if p.TTL == 0 {
+			p.TTL = entry.options.TTL
+		}
+		if entry.options.Tag != "" && !p.HasTag(entry.options.Tag) {
+			p.Tags = append(p.Tags, entry.options.Tag)
+		}
+		for _, group := range entry.options.Groups {
+			if !p.HasTag(group) {
+				p.Tags = append(p.Tags, group)
+			}
+		}
+	}
+
+	if snapshot, ok := entry.source.(SnapshotSource); ok && snapshot.Snapshot() {
+		pm.ReconcileProxies(entry.source.Name(), proxies)
+	} else {
+		for _, p := range proxies {
+			pm.AddProxy(p)
+		}
+	}
+
+	logger.Info("Fetched %d proxies from source %s", len(proxies), entry.source.Name())
+}
+
+// updateSourceExpiry ngừng phục vụ proxy của nguồn khi lần tải thành công cuối đã quá stale window
+func (pm *ProxyManager) updateSourceExpiry(entry *sourceEntry) {
+	name := entry.source.Name()
+	status := entry.breaker.Status()
+	staleFor := time.Since(status.LastSuccess)
+
+	// Nguồn chưa từng tải thành công thì không có proxy cũ để phục vụ
+	expired := false
+	switch {
+	case status.LastSuccess.IsZero():
+	case sourceHealthConfig.StaleWindow > 0 && staleFor > sourceHealthConfig.StaleWindow:
+		expired = true
+	case status.ConsecutiveFailures > 0:
+		logger.Warn("Serving stale proxies from source %s (last success %v ago)", name, staleFor.Round(time.Second))
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if expired == pm.expiredSources[name] {
+		return
+	}
+	if expired {
+		pm.expiredSources[name] = true
+		logger.Warn("Stale window exceeded for source %s, no longer serving its proxies", name)
+	} else {
+		delete(pm.expiredSources, name)
+		logger.Info("Source %s recovered, serving its proxies again", name)
+	}
+}
+
+// SourceStatus là tình trạng của một nguồn upstream
+type SourceStatus struct {
+	Name     string `json:"name"`
+	Interval string `json:"interval"`
+	Priority int    `json:"priority"`
+	Tag      string `json:"tag,omitempty"`
+	Proxies  int    `json:"proxies"`
+	// Stale cho biết lần làm mới gần nhất thất bại và pool đang dùng dữ liệu cũ
+	Stale bool `json:"stale"`
+	// Expired cho biết đã quá stale window và proxy của nguồn không còn được chọn
+	Expired bool `json:"expired"`
+	BreakerStatus
+}
+
+// SourceStatuses trả về tình trạng của tất cả các nguồn đã đăng ký
+func (pm *ProxyManager) SourceStatuses() []SourceStatus {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, p := range pm.proxies {
+		counts[p.Source]++
+	}
+
+	statuses := make([]SourceStatus, 0, len(pm.sources))
+	for _, entry := range pm.sources {
+		name := entry.source.Name()
+		breaker := entry.breaker.Status()
+		statuses = append(statuses, SourceStatus{
+			Name:          name,
+			Interval:      entry.options.Interval.String(),
+			Priority:      entry.options.Priority,
+			Tag:           entry.options.Tag,
+			Proxies:       counts[name],
+			Stale:         breaker.ConsecutiveFailures > 0 && !breaker.LastSuccess.IsZero(),
+			Expired:       pm.expiredSources[name],
+			BreakerStatus: breaker,
+		})
+	}
+	return statuses
+}
+
+// APISource lấy proxy từ endpoint random của Next.js key manager
+type APISource struct {
+	URL string
+}
+
+func (s *APISource) Name() string {
+	return "api:" + s.URL
+}
+
+func (s *APISource) Fetch() ([]*Proxy, error) {
+	return fetchProxyFromURL(s.URL)
+}
+
+// APIListSource lấy toàn bộ key đang hoạt động từ endpoint all của Next.js key manager
+type APIListSource struct {
+	URL string
+}
+
+func (s *APIListSource) Name() string {
+	return "api-all:" + s.URL
+}
+
+func (s *APIListSource) Fetch() ([]*Proxy, error) {
+	return fetchAllProxiesFromURL(s.URL)
+}
+
+func (s *APIListSource) Snapshot() bool {
+	return true
+}
+
+// FileSource đọc danh sách proxy tĩnh từ file
+type FileSource struct {
+	Path string
+	Type ProxyType
+	// Format là định dạng danh sách (text, csv, json, yaml), rỗng thì đoán theo phần mở rộng
+	Format string
+}
+
+func (s *FileSource) Name() string {
+	return "file:" + s.Path
+}
+
+func (s *FileSource) Fetch() ([]*Proxy, error) {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open proxy list file: %v", err)
+	}
+	defer file.Close()
+
+	format := s.Format
+	if format == "" {
+		format = DetectProxyListFormat(s.Path)
+	}
+	return parseProxyList(file, format, s.Type, s.Path)
+}
+
+func (s *FileSource) Snapshot() bool {
+	return true
+}
+
+// URLListSource tải danh sách proxy từ URL từ xa
+type URLListSource struct {
+	URL  string
+	Type ProxyType
+	// Format là định dạng danh sách (text, csv, json, yaml), rỗng thì đoán theo phần mở rộng
+	Format string
+}
+
+func (s *URLListSource) Name() string {
+	return "url:" + redactURL(s.URL)
+}
+
+func (s *URLListSource) Fetch() ([]*Proxy, error) {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch proxy list: %v", urlParseError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy list returned non-200 status code: %d", resp.StatusCode)
+	}
+
+	format := s.Format
+	if format == "" {
+		format = DetectProxyListFormat(s.URL)
+	}
+	return parseProxyList(resp.Body, format, s.Type, s.Name())
+}
+
+func (s *URLListSource) Snapshot() bool {
+	return true
+}
+
+// parseProxyList đọc danh sách proxy theo format, ghi cảnh báo kèm số dòng cho các mục sai
+// định dạng và bỏ qua chúng thay vì bỏ cả danh sách
+func parseProxyList(r io.Reader, format string, proxyType ProxyType, name string) ([]*Proxy, error) {
+	list, err := ParseProxyList(r, format, proxyType)
+	if err != nil {
+		return nil, err
+	}
+	for _, entryErr := range list.Errors {
+		logger.Warn("Skipping invalid proxy in %s at %v", name, entryErr)
+	}
+	return list.Proxies, nil
+}
+
+// SourceConfig là một phần tử trong file cấu hình nguồn upstream
+type SourceConfig struct {
+	Type      string    `json:"type"`
+	URL       string    `json:"url"`
+	Path      string    `json:"path"`
+	ProxyType ProxyType `json:"proxy_type"`
+	Format    string    `json:"format"`
+	Interval  string    `json:"interval"`
+	Priority  int       `json:"priority"`
+	Weight    int       `json:"weight"`
+	Tag       string    `json:"tag"`
+	Groups    []string  `json:"groups"`
+	TTL       string    `json:"ttl"`
+}
+
+// LoadSourcesConfig đọc danh sách nguồn upstream từ file JSON
+func LoadSourcesConfig(path string) ([]SourceConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sources file: %v", err)
+	}
+
+	var configs []SourceConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse sources file: %v", err)
+	}
+	return configs, nil
+}
+
+// NewSourceFromConfig tạo UpstreamSource và SourceOptions từ cấu hình
+func NewSourceFromConfig(cfg SourceConfig) (UpstreamSource, SourceOptions, error) {
+	options := SourceOptions{
+		Interval: 5 * time.Minute,
+		Priority: cfg.Priority,
+		Weight:   cfg.Weight,
+		Tag:      cfg.Tag,
+		Groups:   cfg.Groups,
+	}
+
+	if cfg.Interval != "" {
+		interval, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, options, fmt.Errorf("invalid interval %q: %v", cfg.Interval, err)
+		}
+		options.Interval = interval
+	}
+
+	if cfg.TTL != "" {
+		ttl, err := time.ParseDuration(cfg.TTL)
+		if err != nil {
+			return nil, options, fmt.Errorf("invalid ttl %q: %v", cfg.TTL, err)
+		}
+		options.TTL = ttl
+	}
+
+	proxyType := cfg.ProxyType
+	if proxyType == "" {
+		proxyType = ProxyTypeHTTP
+	}
+
+	switch strings.ToLower(cfg.Format) {
+	case "", ProxyListText, ProxyListCSV, ProxyListJSON, ProxyListYAML, "yml":
+	default:
+		return nil, options, fmt.Errorf("unknown proxy list format %q (expected text, csv, json or yaml)", cfg.Format)
+	}
+
+	switch cfg.Type {
+	case "api":
+		if cfg.URL == "" {
+			return nil, options, fmt.Errorf("api source requires url")
+		}
+		if cfg.TTL == "" {
+			options.TTL = defaultAPITTL
+		}
+		return &APISource{URL: cfg.URL}, options, nil
+	case "api-all":
+		if cfg.URL == "" {
+			return nil, options, fmt.Errorf("api-all source requires url")
+		}
+		return &APIListSource{URL: cfg.URL}, options, nil
+	case "file":
+		if cfg.Path == "" {
+			return nil, options, fmt.Errorf("file source requires path")
+		}
+		return &FileSource{Path: cfg.Path, Type: proxyType, Format: cfg.Format}, options, nil
+	case "url":
+		if cfg.URL == "" {
+			return nil, options, fmt.Errorf("url source requires url")
+		}
+		return &URLListSource{URL: cfg.URL, Type: proxyType, Format: cfg.Format}, options, nil
+	default:
+		return nil, options, fmt.Errorf("unknown source type %q", cfg.Type)
+	}
+}
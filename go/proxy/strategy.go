@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+// Strategy chọn một upstream trong danh sách ứng viên. ProxyManager chỉ truyền vào các proxy
+// đang dùng được, cùng priority cao nhất, và luôn có ít nhất một phần tử.
+type Strategy interface {
+	Name() string
+	Select(candidates []*Proxy) *Proxy
+}
+
+// Tên các strategy hỗ trợ trong cấu hình
+const (
+	StrategyRoundRobin   = "round-robin"
+	StrategyRandom       = "random"
+	StrategyWeighted     = "weighted"
+	StrategyLeastConn    = "least-conn"
+	StrategyLeastLatency = "least-latency"
+	StrategyLRU          = "lru"
+	StrategyHealth       = "health"
+)
+
+// NewStrategy tạo strategy theo tên
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case StrategyRoundRobin:
+		return &roundRobinStrategy{}, nil
+	case StrategyRandom, "":
+		return randomStrategy{}, nil
+	case StrategyWeighted:
+		return weightedStrategy{}, nil
+	case StrategyLeastConn:
+		return leastConnStrategy{}, nil
+	case StrategyLeastLatency:
+		return leastLatencyStrategy{}, nil
+	case StrategyLRU:
+		return lruStrategy{}, nil
+	case StrategyHealth:
+		return healthStrategy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown selection strategy %q", name)
+	}
+}
+
+// roundRobinStrategy lần lượt chọn từng ứng viên
+type roundRobinStrategy struct {
+	next uint64
+}
+
+func (s *roundRobinStrategy) Name() string { return StrategyRoundRobin }
+
+func (s *roundRobinStrategy) Select(candidates []*Proxy) *Proxy {
+	n := atomic.AddUint64(&s.next, 1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+// randomStrategy chọn ngẫu nhiên đều
+type randomStrategy struct{}
+
+func (randomStrategy) Name() string { return StrategyRandom }
+
+func (randomStrategy) Select(candidates []*Proxy) *Proxy {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// weightedStrategy chọn ngẫu nhiên theo Weight, proxy không đặt weight được tính là 1
+type weightedStrategy struct{}
+
+func (weightedStrategy) Name() string { return StrategyWeighted }
+
+func (weightedStrategy) Select(candidates []*Proxy) *Proxy {
+	total := 0
+	for _, p := range candidates {
+		total += p.effectiveWeight()
+	}
+
+	n := rand.Intn(total)
+	for _, p := range candidates {
+		n -= p.effectiveWeight()
+		if n < 0 {
+			return p
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// leastConnStrategy chọn proxy có ít kết nối đang mở nhất, hòa thì chọn proxy lâu chưa dùng nhất
+type leastConnStrategy struct{}
+
+func (leastConnStrategy) Name() string { return StrategyLeastConn }
+
+func (leastConnStrategy) Select(candidates []*Proxy) *Proxy {
+	selected := candidates[0]
+	selectedConns := atomic.LoadInt64(&selected.ActiveConns)
+	for _, p := range candidates[1:] {
+		conns := atomic.LoadInt64(&p.ActiveConns)
+		if conns < selectedConns || (conns == selectedConns && p.LastUsed().Before(selected.LastUsed())) {
+			selected = p
+			selectedConns = conns
+		}
+	}
+	return selected
+}
+
+// leastLatencyStrategy chọn proxy có độ trễ kết nối (EWMA) thấp nhất,
+// proxy chưa có số đo được ưu tiên để có dữ liệu
+type leastLatencyStrategy struct{}
+
+func (leastLatencyStrategy) Name() string { return StrategyLeastLatency }
+
+func (leastLatencyStrategy) Select(candidates []*Proxy) *Proxy {
+	selected := candidates[0]
+	for _, p := range candidates[1:] {
+		if latencyLess(p, selected) {
+			selected = p
+		}
+	}
+	return selected
+}
+
+func latencyLess(a, b *Proxy) bool {
+	aLatency, bLatency := a.Latency(), b.Latency()
+	switch {
+	case aLatency == 0 && bLatency == 0:
+		return a.LastUsed().Before(b.LastUsed())
+	case aLatency == 0:
+		return true
+	case bLatency == 0:
+		return false
+	default:
+		return aLatency < bLatency
+	}
+}
+
+// lruStrategy chọn proxy lâu chưa được dùng nhất
+type lruStrategy struct{}
+
+func (lruStrategy) Name() string { return StrategyLRU }
+
+func (lruStrategy) Select(candidates []*Proxy) *Proxy {
+	selected := candidates[0]
+	for _, p := range candidates[1:] {
+		if p.LastUsed().Before(selected.LastUsed()) {
+			selected = p
+		}
+	}
+	return selected
+}
+
+// healthStrategy chọn ngẫu nhiên theo điểm sức khỏe nhân weight, điểm được bình phương
+// để proxy tốt nhận phần lớn traffic nhưng proxy kém vẫn có traffic để đo lại
+type healthStrategy struct{}
+
+func (healthStrategy) Name() string { return StrategyHealth }
+
+func (healthStrategy) Select(candidates []*Proxy) *Proxy {
+	scores := make([]float64, len(candidates))
+	total := 0.0
+	for i, p := range candidates {
+		score := p.HealthScore()
+		scores[i] = score * score * float64(p.effectiveWeight())
+		total += scores[i]
+	}
+	if total <= 0 {
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	n := rand.Float64() * total
+	for i, p := range candidates {
+		n -= scores[i]
+		if n < 0 {
+			return p
+		}
+	}
+	return candidates[len(candidates)-1]
+}
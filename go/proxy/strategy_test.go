@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func strategyCandidates(n int) []*Proxy {
+	candidates := make([]*Proxy, n)
+	for i := range candidates {
+		candidates[i] = &Proxy{
+			URL:       fmt.Sprintf("http://10.0.0.%d:8080", i+1),
+			Type:      ProxyTypeHTTP,
+			IsWorking: true,
+		}
+	}
+	return candidates
+}
+
+func mustStrategy(t *testing.T, name string) Strategy {
+	t.Helper()
+	strategy, err := NewStrategy(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strategy
+}
+
+func TestRoundRobinCycles(t *testing.T) {
+	candidates := strategyCandidates(3)
+	strategy := mustStrategy(t, StrategyRoundRobin)
+
+	for i := 0; i < 9; i++ {
+		if got, want := strategy.Select(candidates), candidates[i%3]; got != want {
+			t.Fatalf("select %d: got %s, want %s", i, got.URL, want.URL)
+		}
+	}
+}
+
+func TestWeightedDistribution(t *testing.T) {
+	candidates := strategyCandidates(3)
+	candidates[0].Weight = 1
+	candidates[1].Weight = 3
+	// candidates[2] không đặt weight nên được tính là 1
+	strategy := mustStrategy(t, StrategyWeighted)
+
+	const draws = 50000
+	counts := make(map[*Proxy]int)
+	for i := 0; i < draws; i++ {
+		counts[strategy.Select(candidates)]++
+	}
+
+	for i, want := range []float64{0.2, 0.6, 0.2} {
+		got := float64(counts[candidates[i]]) / draws
+		if got < want-0.03 || got > want+0.03 {
+			t.Errorf("candidate %d: got share %.3f, want %.2f", i, got, want)
+		}
+	}
+}
+
+func TestLeastConnBreaksTiesByLastUsed(t *testing.T) {
+	candidates := strategyCandidates(3)
+	now := time.Now()
+	atomic.StoreInt64(&candidates[0].ActiveConns, 5)
+	candidates[0].touch(now.Add(-time.Hour))
+	atomic.StoreInt64(&candidates[1].ActiveConns, 1)
+	candidates[1].touch(now)
+	atomic.StoreInt64(&candidates[2].ActiveConns, 1)
+	candidates[2].touch(now.Add(-time.Minute))
+	strategy := mustStrategy(t, StrategyLeastConn)
+
+	if got := strategy.Select(candidates); got != candidates[2] {
+		t.Fatalf("got %s, want least recently used of the least loaded", got.URL)
+	}
+
+	atomic.StoreInt64(&candidates[1].ActiveConns, 0)
+	if got := strategy.Select(candidates); got != candidates[1] {
+		t.Fatalf("got %s, want proxy with fewest connections", got.URL)
+	}
+}
+
+func TestLeastLatencyPrefersUnmeasured(t *testing.T) {
+	candidates := strategyCandidates(3)
+	now := time.Now()
+	atomic.StoreInt64(&candidates[0].metrics.latency, int64(50*time.Millisecond))
+	atomic.StoreInt64(&candidates[1].metrics.latency, int64(20*time.Millisecond))
+	strategy := mustStrategy(t, StrategyLeastLatency)
+
+	// Proxy chưa có số đo (Latency == 0) được chọn trước để có dữ liệu
+	if got := strategy.Select(candidates); got != candidates[2] {
+		t.Fatalf("got %s, want unmeasured proxy", got.URL)
+	}
+
+	// Khi đã đo hết, chọn proxy có độ trễ thấp nhất
+	atomic.StoreInt64(&candidates[2].metrics.latency, int64(100*time.Millisecond))
+	if got := strategy.Select(candidates); got != candidates[1] {
+		t.Fatalf("got %s, want lowest latency", got.URL)
+	}
+
+	// Nhiều proxy chưa đo thì chọn proxy lâu chưa dùng nhất
+	unmeasured := strategyCandidates(2)
+	unmeasured[0].touch(now)
+	unmeasured[1].touch(now.Add(-time.Minute))
+	if got := strategy.Select(unmeasured); got != unmeasured[1] {
+		t.Fatalf("got %s, want least recently used unmeasured proxy", got.URL)
+	}
+}
+
+func TestLRUOrdering(t *testing.T) {
+	candidates := strategyCandidates(3)
+	now := time.Now()
+	for i, p := range candidates {
+		p.touch(now.Add(time.Duration(i) * time.Second))
+	}
+	strategy := mustStrategy(t, StrategyLRU)
+
+	for i := 0; i < 6; i++ {
+		want := candidates[i%3]
+		got := strategy.Select(candidates)
+		if got != want {
+			t.Fatalf("select %d: got %s, want %s", i, got.URL, want.URL)
+		}
+		got.touch(now.Add(time.Duration(3+i) * time.Second))
+	}
+}
+
+func TestParseListenersSeparateStrategies(t *testing.T) {
+	listeners, err := ParseListeners(":8080=round-robin, :8081=round-robin, :8082")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 3 {
+		t.Fatalf("got %d listeners, want 3", len(listeners))
+	}
+	if listeners[2].Strategy != nil {
+		t.Fatalf("listener without strategy got %s", listeners[2].Strategy.Name())
+	}
+
+	first, second := listeners[0].Strategy, listeners[1].Strategy
+	if first == nil || second == nil || first == second {
+		t.Fatal("listeners must not share a strategy instance")
+	}
+
+	// Mỗi listener giữ con trỏ round-robin riêng
+	candidates := strategyCandidates(2)
+	first.Select(candidates)
+	if got := second.Select(candidates); got != candidates[0] {
+		t.Fatalf("second listener started at %s, want %s", got.URL, candidates[0].URL)
+	}
+
+	if _, err := ParseListeners(":8080=fastest"); err == nil {
+		t.Fatal("expected error for unknown strategy")
+	}
+}
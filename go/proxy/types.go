@@ -1,6 +1,14 @@
 package proxy
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // ProxyType định nghĩa loại proxy
 type ProxyType string
@@ -8,21 +16,172 @@ type ProxyType string
 const (
 	// ProxyTypeHTTP là loại proxy HTTP
 	ProxyTypeHTTP ProxyType = "http"
+	// ProxyTypeSOCKS4 là loại proxy SOCKS4 (SOCKS4a khi đích là tên miền)
+	ProxyTypeSOCKS4 ProxyType = "socks4"
 	// ProxyTypeSOCKS5 là loại proxy SOCKS5
 	ProxyTypeSOCKS5 ProxyType = "socks5"
 	// ProxyTypeUnknown là loại proxy chưa xác định
 	ProxyTypeUnknown ProxyType = "unknown"
 )
 
-// Proxy đại diện cho một proxy server
+// Proxy đại diện cho một proxy server.
+//
+// URL, thông tin đăng nhập và metadata không đổi sau khi proxy vào pool nên đọc được
+// mà không cần khóa; khi nguồn trả về dữ liệu mới, ProxyManager thay cả proxy bằng bản mới
+// (xem updateProxy). Riêng RefreshedAt, TTL và serveUntil được sửa tại chỗ và chỉ đọc khi giữ
+// ProxyManager.mu. Trạng thái sức khỏe (từ FailCount tới TrialSuccesses) được mu của proxy
+// bảo vệ để request trên các proxy khác nhau không tranh nhau một khóa chung. Bộ đếm và chỉ số
+// thụ động dùng sync/atomic nên đọc được khi chọn proxy mà không cần khóa proxy.
 type Proxy struct {
-	URL         string
-	Username    string
-	Password    string
-	AuthHeader  string
-	LastUsed    time.Time
+	// Các trường đọc khi duyệt pool để chọn proxy được đặt liền nhau ở đầu struct
+	// để mỗi proxy chỉ tốn ít cache line khi pool lớn.
+
+	// ActiveConns là số kết nối đang mở qua proxy, truy cập bằng sync/atomic
+	ActiveConns int64
+	// serveUntil là thời điểm (unix nano) proxy hết được chọn do key hết hạn hoặc quá TTL,
+	// 0 là không giới hạn; tính sẵn khi proxy vào pool hoặc được cập nhật (xem lifecycle.go)
+	serveUntil int64
+	// trialSince là thời điểm (unix nano) proxy half-open được giữ cho một kết nối thử,
+	// 0 là chưa có kết nối thử nào; chỉ đặt bằng CAS khi chọn proxy (xem reserveTrial)
+	trialSince int64
+	// status là bản sao atomic của State và IsWorking dùng khi chọn proxy
+	status   int32
+	Priority int
+	Type     ProxyType
+	URL      string
+	Source   string
+
+	Username   string
+	Password   string
+	AuthHeader string
+
+	mu          sync.Mutex
 	FailCount   int
 	LastChecked time.Time
-	IsWorking   bool
-	Type        ProxyType
+	// LastCheckError là lỗi của lần kiểm tra sức khỏe gần nhất, rỗng nếu đã qua
+	LastCheckError string
+	IsWorking      bool
+	// Trạng thái cách ly, xem quarantine.go. IsWorking là false khi proxy đang bị cách ly.
+	State          ProxyState
+	StateChanged   time.Time
+	RetryAt        time.Time
+	Backoff        time.Duration
+	TrialSuccesses int
+
+	Carrier    string
+	Location   string
+	KeyID      string
+	Expiration string
+	ExpiresAt  time.Time
+	Tags       []string
+	Weight     int
+	// AddedAt là lúc proxy vào pool, RefreshedAt là lần cuối nguồn trả về proxy.
+	// Proxy có TTL > 0 bị gỡ khi quá TTL kể từ RefreshedAt, xem lifecycle.go.
+	AddedAt     time.Time
+	RefreshedAt time.Time
+	TTL         time.Duration
+
+	// Requests và Failures là số request đã phục vụ và số lần lỗi, truy cập bằng sync/atomic
+	Requests int64
+	Failures int64
+	// lastUsed là lần cuối proxy được chọn (unix nano), truy cập bằng sync/atomic
+	lastUsed int64
+	// metrics là các chỉ số thụ động từ traffic thật (EWMA), xem metrics.go
+	metrics proxyMetrics
+}
+
+// LastUsed trả về lần cuối proxy được chọn
+func (p *Proxy) LastUsed() time.Time {
+	nanos := atomic.LoadInt64(&p.lastUsed)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// touch ghi nhận proxy vừa được chọn
+func (p *Proxy) touch(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	atomic.StoreInt64(&p.lastUsed, t.UnixNano())
+}
+
+// HasTag kiểm tra proxy có thuộc nhóm/nhãn tag không
+func (p *Proxy) HasTag(tag string) bool {
+	for _, t := range p.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// effectiveWeight trả về weight dùng khi chọn proxy, mặc định là 1
+func (p *Proxy) effectiveWeight() int {
+	if p.Weight <= 0 {
+		return 1
+	}
+	return p.Weight
+}
+
+// Redacted trả về URL của proxy đã che mật khẩu, dùng khi ghi log
+func (p *Proxy) Redacted() string {
+	return redactURL(p.URL)
+}
+
+// Describe trả về mô tả proxy kèm key, nhà mạng và vị trí để ghi log
+func (p *Proxy) Describe() string {
+	var meta []string
+	if p.KeyID != "" {
+		meta = append(meta, "key="+maskKey(p.KeyID))
+	}
+	if p.Carrier != "" {
+		meta = append(meta, "carrier="+p.Carrier)
+	}
+	if p.Location != "" {
+		meta = append(meta, "location="+p.Location)
+	}
+	if len(meta) == 0 {
+		return p.Redacted()
+	}
+	return fmt.Sprintf("%s [%s]", p.Redacted(), strings.Join(meta, " "))
+}
+
+// maskKey chỉ giữ vài ký tự đầu và cuối của key để nhận diện mà không lộ toàn bộ
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return "****"
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
+
+// redactURL che phần mật khẩu trong URL
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		if strings.Contains(raw, "@") {
+			return "[redacted]"
+		}
+		return raw
+	}
+	return u.Redacted()
+}
+
+// urlParseError bỏ URL gốc (có thể chứa mật khẩu) khỏi lỗi của url.Parse
+func urlParseError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+// isSensitiveHeader kiểm tra header có chứa thông tin đăng nhập không
+func isSensitiveHeader(key string) bool {
+	switch strings.ToLower(key) {
+	case "proxy-authorization", "authorization", "cookie", "set-cookie":
+		return true
+	}
+	return false
 }
@@ -0,0 +1,344 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialTunnel mở tunnel TCP tới host:port qua upstream được chọn (CONNECT với proxy HTTP,
+// lệnh CONNECT với proxy SOCKS4/SOCKS5), thử lại với upstream khác tối đa maxRetries lần
+func (pm *ProxyManager) dialTunnel(identity *Identity, selector ProxySelector, strategy Strategy, host string, port int) (net.Conn, *Proxy, error) {
+	var lastError error
+	var excludeURL string
+
+	maxRetries := pm.retriesFor(identity)
+	for retry := 0; retry <= maxRetries; retry++ {
+		proxy := pm.GetProxyForRoute(identity, excludeURL, selector, strategy)
+		if proxy == nil {
+			if lastError == nil {
+				lastError = fmt.Errorf("no proxy available")
+			}
+			return nil, nil, lastError
+		}
+		excludeURL = proxy.URL
+
+		conn, err := pm.dialThrough(proxy, host, port)
+		if err != nil {
+			logger.Error("Failed to open tunnel via %s: %v", proxy.Describe(), err)
+			lastError = err
+			pm.MarkProxyFailed(proxy)
+			continue
+		}
+
+		pm.MarkProxySuccess(proxy)
+		return conn, proxy, nil
+	}
+
+	return nil, nil, fmt.Errorf("all proxy attempts failed, last error: %v", lastError)
+}
+
+// dialThrough kết nối tới proxy và yêu cầu proxy mở kết nối tới host:port
+func (pm *ProxyManager) dialThrough(proxy *Proxy, host string, port int) (net.Conn, error) {
+	dialStart := time.Now()
+	conn, err := dialProxy(proxy, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	pm.ObserveLatency(proxy, time.Since(dialStart))
+
+	// Giới hạn thời gian bắt tay với proxy
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := openTunnel(conn, proxy, host, port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// openTunnel yêu cầu upstream đã kết nối mở tunnel tới host:port theo giao thức của upstream
+func openTunnel(conn net.Conn, proxy *Proxy, host string, port int) error {
+	switch proxyTypeOf(proxy) {
+	case ProxyTypeSOCKS5:
+		return socks5Connect(conn, proxy, host, port)
+	case ProxyTypeSOCKS4:
+		return socks4Connect(conn, proxy, host, port)
+	default:
+		return httpConnect(conn, proxy, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+}
+
+// dialProxy mở kết nối tới upstream trong thời hạn timeout, bắt tay TLS nếu upstream là proxy https
+func dialProxy(proxy *Proxy, timeout time.Duration) (net.Conn, error) {
+	rawURL := proxy.URL
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, urlParseError(err)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("proxy URL has no host")
+	}
+
+	deadline := time.Now().Add(timeout)
+	conn, err := net.DialTimeout("tcp", proxyURL.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme != "https" {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+	tlsConn.SetDeadline(deadline)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with proxy failed: %v", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// httpConnect gửi CONNECT tới proxy HTTP và chờ phản hồi 200
+func httpConnect(conn net.Conn, proxy *Proxy, hostPort string) error {
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", hostPort, hostPort)
+	if proxy.Username != "" && proxy.Password != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", proxy.Username, proxy.Password)))
+		request += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", auth)
+	}
+	request += "\r\n"
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return fmt.Errorf("failed to send CONNECT request: %v", err)
+	}
+
+	// Đọc từng byte để không đọc lẫn dữ liệu của tunnel
+	reader := bufio.NewReaderSize(&byteReader{conn}, 16)
+	statusLine, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read CONNECT response: %v", err)
+	}
+
+	fields := strings.Fields(statusLine)
+	if len(fields) < 2 || fields[1] != "200" {
+		return fmt.Errorf("proxy returned: %s", strings.TrimSpace(statusLine))
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read CONNECT response headers: %v", err)
+		}
+		if strings.TrimSpace(line) == "" {
+			return nil
+		}
+	}
+}
+
+// byteReader đọc tối đa một byte mỗi lần để bufio không đọc quá phần header
+type byteReader struct {
+	r io.Reader
+}
+
+func (b *byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return b.r.Read(p)
+}
+
+// socks5Connect bắt tay SOCKS5 (kèm user/pass nếu có) và yêu cầu proxy kết nối tới host:port
+func socks5Connect(conn net.Conn, proxy *Proxy, host string, port int) error {
+	methods := []byte{0x00}
+	if proxy.Username != "" && proxy.Password != "" {
+		methods = []byte{0x00, 0x02}
+	}
+
+	greeting := append([]byte{SOCKS5_VERSION, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("failed to send auth methods: %v", err)
+	}
+
+	authResp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, authResp); err != nil {
+		return fmt.Errorf("failed to read auth response: %v", err)
+	}
+	if authResp[0] != SOCKS5_VERSION {
+		return fmt.Errorf("invalid SOCKS version in auth response: %d", authResp[0])
+	}
+
+	switch authResp[1] {
+	case 0x00:
+	case 0x02:
+		if proxy.Username == "" || proxy.Password == "" {
+			return fmt.Errorf("proxy requires authentication")
+		}
+		authReq := []byte{0x01, byte(len(proxy.Username))}
+		authReq = append(authReq, proxy.Username...)
+		authReq = append(authReq, byte(len(proxy.Password)))
+		authReq = append(authReq, proxy.Password...)
+		if _, err := conn.Write(authReq); err != nil {
+			return fmt.Errorf("failed to send authentication: %v", err)
+		}
+
+		status := make([]byte, 2)
+		if _, err := io.ReadFull(conn, status); err != nil {
+			return fmt.Errorf("failed to read auth status: %v", err)
+		}
+		if status[1] != 0x00 {
+			return fmt.Errorf("authentication failed")
+		}
+	default:
+		return fmt.Errorf("proxy did not accept authentication method: %d", authResp[1])
+	}
+
+	request := []byte{SOCKS5_VERSION, SOCKS5_CMD_CONNECT, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(request, SOCKS5_ADDR_TYPE_IPV4)
+			request = append(request, ip4...)
+		} else {
+			request = append(request, SOCKS5_ADDR_TYPE_IPV6)
+			request = append(request, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("target host too long")
+		}
+		request = append(request, SOCKS5_ADDR_TYPE_DOMAIN, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("failed to send connection request: %v", err)
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read connection response: %v", err)
+	}
+	if reply[0] != SOCKS5_VERSION {
+		return fmt.Errorf("invalid SOCKS version in response: %d", reply[0])
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("proxy connection failed: %d", reply[1])
+	}
+
+	// Bỏ qua BND.ADDR và BND.PORT
+	var skip int
+	switch reply[3] {
+	case SOCKS5_ADDR_TYPE_IPV4:
+		skip = 4 + 2
+	case SOCKS5_ADDR_TYPE_IPV6:
+		skip = 16 + 2
+	case SOCKS5_ADDR_TYPE_DOMAIN:
+		lenByte := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenByte); err != nil {
+			return fmt.Errorf("failed to read bound address: %v", err)
+		}
+		skip = int(lenByte[0]) + 2
+	default:
+		return fmt.Errorf("unknown address type in response: %d", reply[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip)); err != nil {
+		return fmt.Errorf("failed to read bound address: %v", err)
+	}
+	return nil
+}
+
+// Các hằng số SOCKS4
+const (
+	SOCKS4_VERSION        = 0x04
+	SOCKS4_CMD_CONNECT    = 0x01
+	SOCKS4_REPLY_GRANTED  = 0x5a
+	SOCKS4_REPLY_LENGTH   = 8
+	socks4MaxUserIDLength = 255
+)
+
+// socks4Connect yêu cầu proxy SOCKS4 kết nối tới host:port. Đích là tên miền được gửi theo
+// SOCKS4a (IP 0.0.0.1 kèm tên miền) để proxy tự phân giải; SOCKS4 không hỗ trợ IPv6.
+// Username của proxy (nếu có) được gửi làm user ID.
+func socks4Connect(conn net.Conn, proxy *Proxy, host string, port int) error {
+	if len(proxy.Username) > socks4MaxUserIDLength {
+		return fmt.Errorf("proxy username too long")
+	}
+
+	request := []byte{SOCKS4_VERSION, SOCKS4_CMD_CONNECT, byte(port >> 8), byte(port)}
+	var domain string
+	if ip := net.ParseIP(host); ip != nil {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return fmt.Errorf("SOCKS4 does not support IPv6 target %s", host)
+		}
+		request = append(request, ip4...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("target host too long")
+		}
+		request = append(request, 0, 0, 0, 1)
+		domain = host
+	}
+	request = append(request, proxy.Username...)
+	request = append(request, 0x00)
+	if domain != "" {
+		request = append(request, domain...)
+		request = append(request, 0x00)
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("failed to send connection request: %v", err)
+	}
+
+	reply := make([]byte, SOCKS4_REPLY_LENGTH)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read connection response: %v", err)
+	}
+	if reply[0] != 0x00 {
+		return fmt.Errorf("invalid SOCKS4 reply version: %d", reply[0])
+	}
+	if reply[1] != SOCKS4_REPLY_GRANTED {
+		return fmt.Errorf("proxy connection failed: %d", reply[1])
+	}
+	return nil
+}
+
+// forwardHTTPRequest gửi request HTTP của client (dạng origin-form) qua kết nối đã mở tới đích,
+// sau đó chuyển tiếp dữ liệu hai chiều cho tới khi một bên đóng
+func forwardHTTPRequest(clientConn net.Conn, reader *bufio.Reader, upstream net.Conn, method, targetURL string, headers map[string]string) error {
+	requestURI := targetURL
+	if parsedURL, err := url.Parse(targetURL); err == nil && parsedURL.Host != "" {
+		requestURI = parsedURL.RequestURI()
+	}
+
+	var request strings.Builder
+	request.WriteString(fmt.Sprintf("%s %s HTTP/1.1\r\n", method, requestURI))
+	for key, value := range headers {
+		switch strings.ToLower(key) {
+		case "proxy-authorization", "proxy-connection", "connection", strings.ToLower(sessionHeader):
+			continue
+		}
+		request.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
+	}
+	request.WriteString("Connection: close\r\n\r\n")
+
+	if _, err := upstream.Write([]byte(request.String())); err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Body (nếu có) vẫn nằm trong reader của client
+	go io.Copy(upstream, reader)
+	_, err := io.Copy(clientConn, upstream)
+	return err
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Identity là danh tính của client sau khi xác thực thành công
+type Identity struct {
+	Username string
+	Route    RouteOptions
+	Limits   *QuotaLimits
+	Groups   []string
+}
+
+// AuthRequest chứa thông tin client gửi lên để xác thực
+type AuthRequest struct {
+	Username   string
+	Password   string
+	Protocol   string
+	ClientIP   string
+	TargetHost string
+}
+
+// Authenticator là interface chung cho xác thực HTTP, CONNECT và SOCKS5
+type Authenticator interface {
+	Authenticate(req *AuthRequest) (*Identity, error)
+}
+
+var (
+	authenticator Authenticator
+
+	// errInvalidCredentials đánh dấu lỗi do sai thông tin đăng nhập (tính vào bộ đếm khóa)
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// ConfigureAuthenticator thiết lập authenticator dùng cho mọi kết nối
+func ConfigureAuthenticator(a Authenticator) {
+	if a != nil {
+		authenticator = a
+	}
+}
+
+// authenticate tách tùy chọn route khỏi username rồi xác thực user gốc
+func authenticate(req *AuthRequest) (*Identity, error) {
+	if authenticator == nil {
+		return nil, fmt.Errorf("no authenticator configured")
+	}
+
+	username, route, err := parseUsername(req.Username)
+	if err != nil {
+		return nil, fmt.Errorf("invalid username: %v", err)
+	}
+
+	// Từ chối ngay nếu IP hoặc user đang bị khóa do đoán sai mật khẩu
+	keys := lockoutKeys(req.ClientIP, username)
+	if err := authLimiter.Check(keys...); err != nil {
+		return nil, err
+	}
+
+	base := *req
+	base.Username = username
+	identity, err := authenticator.Authenticate(&base)
+	if err != nil {
+		if errors.Is(err, errInvalidCredentials) {
+			for _, key := range keys {
+				authLimiter.Failure(key)
+			}
+		}
+		return nil, err
+	}
+	authLimiter.Success(userLockoutKey(req.ClientIP, username))
+
+	identity.Route = route
+	return identity, nil
+}
+
+// UserStore lưu danh sách user từ file định dạng htpasswd (bcrypt hoặc {SHA})
+type UserStore struct {
+	path    string
+	mu      sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+}
+
+// NewUserStore tạo user store và tải dữ liệu từ file
+func NewUserStore(path string) (*UserStore, error) {
+	s := &UserStore{
+		path:  path,
+		users: make(map[string]string),
+	}
+	if err := s.Load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load đọc lại toàn bộ file user
+func (s *UserStore) Load() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to open users file: %v", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat users file: %v", err)
+	}
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" || hash == "" {
+			logger.Warn("Skipping invalid users entry at line %d", lineNum)
+			continue
+		}
+		if !isSupportedHash(hash) {
+			logger.Warn("Skipping user %s at line %d: unsupported password hash", username, lineNum)
+			continue
+		}
+		users[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read users file: %v", err)
+	}
+
+	s.mu.Lock()
+	s.users = users
+	s.modTime = stat.ModTime()
+	s.mu.Unlock()
+
+	logger.Info("Loaded %d users from %s", len(users), s.path)
+	return nil
+}
+
+// Watch theo dõi file user và tải lại khi file thay đổi
+func (s *UserStore) Watch(interval time.Duration) {
+	s.mu.RLock()
+	modTime := s.modTime
+	s.mu.RUnlock()
+
+	watchFile(s.path, modTime, interval, s.Load)
+}
+
+// Authenticate kiểm tra username/password với dữ liệu trong file
+func (s *UserStore) Authenticate(req *AuthRequest) (*Identity, error) {
+	s.mu.RLock()
+	hash, exists := s.users[req.Username]
+	s.mu.RUnlock()
+
+	if !exists || !verifyPassword(hash, req.Password) {
+		return nil, fmt.Errorf("%w for user %q", errInvalidCredentials, req.Username)
+	}
+
+	return &Identity{Username: req.Username}, nil
+}
+
+// isSupportedHash kiểm tra định dạng hash có được hỗ trợ không
+func isSupportedHash(hash string) bool {
+	return isBcryptHash(hash) || strings.HasPrefix(hash, "{SHA}")
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// verifyPassword so sánh password với hash theo định dạng htpasswd
+func verifyPassword(hash, password string) bool {
+	if isBcryptHash(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(strings.TrimPrefix(hash, "{SHA}"))) == 1
+	}
+
+	return false
+}
+
+// watchFile kiểm tra file định kỳ và gọi reload khi thời gian sửa đổi thay đổi
+func watchFile(path string, modTime time.Time, interval time.Duration, reload func() error) {
+	for {
+		time.Sleep(interval)
+
+		stat, err := os.Stat(path)
+		if err != nil || stat.ModTime().Equal(modTime) {
+			continue
+		}
+
+		logger.Info("File %s changed, reloading", path)
+		if err := reload(); err != nil {
+			logger.Error("Error reloading %s: %v", path, err)
+		}
+		modTime = stat.ModTime()
+	}
+}
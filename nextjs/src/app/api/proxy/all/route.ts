@@ -0,0 +1,31 @@
+import { NextResponse } from 'next/server';
+import { dbService } from '@server/database';
+
+// Chỉ export các hàm route handler
+export const dynamic = 'force-dynamic';
+export const revalidate = 0;
+
+export async function GET() {
+  try {
+    const keys = await dbService.getKeys();
+    const validKeys = keys.filter(key => 
+      key.proxyData?.status === 100 && 
+      key.isActive
+    );
+
+    // Trả về toàn bộ key đang hoạt động để proxy server đồng bộ pool
+    return NextResponse.json({
+      proxies: validKeys.map(key => ({
+        proxyData: key.proxyData,
+        key: key.key,
+        lastRotatedAt: key.lastRotatedAt
+      }))
+    });
+  } catch (error) {
+    console.error('Failed to get proxy list:', error);
+    return NextResponse.json(
+      { error: error instanceof Error ? error.message : 'Failed to get proxy list' },
+      { status: 500 }
+    );
+  }
+}